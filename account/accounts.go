@@ -1,352 +1,606 @@
-/*
-Licensed to the Apache Software Foundation (ASF) under one
-or more contributor license agreements.  See the NOTICE file
-distributed with this work for additional information
-regarding copyright ownership.  The ASF licenses this file
-to you under the Apache License, Version 2.0 (the
-"License"); you may not use this file except in compliance
-with the License.  You may obtain a copy of the License at
-
-  http://www.apache.org/licenses/LICENSE-2.0
-
-Unless required by applicable law or agreed to in writing,
-software distributed under the License is distributed on an
-"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
-KIND, either express or implied.  See the License for the
-specific language governing permissions and limitations
-under the License.
-*/
-
-package main
-
-import (
-	"errors"
-	"fmt"
-	"strconv"
-	"encoding/json"
-	"strings"
-
-	"github.com/hyperledger/fabric/core/chaincode/shim"
-)
-
-// SimpleChaincode example simple Chaincode implementation
-type SimpleChaincode struct {
-}
-
-var accountIndexStr = "_accountindex"			
-
-type Account struct{
-	AccountNo string `json:"accountno"`	
-	LegalEntity string `json:"legalentity"`
-	Currency string `json:"currency"`				
-	Balance string `json:"balance"`
-}
-
-// ============================================================================================================================
-// Main
-// ============================================================================================================================
-func main() {
-	err := shim.Start(new(SimpleChaincode))
-	if err != nil {
-		fmt.Printf("Error starting Simple chaincode: %s", err)
-	}
-}
-
-// ============================================================================================================================
-// Init - reset all the things
-// ============================================================================================================================
-func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	var Aval int
-	var err error
-
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
-	}
-
-	// Initialize the chaincode
-	Aval, err = strconv.Atoi(args[0])
-	if err != nil {
-		return nil, errors.New("Expecting integer value for asset holding")
-	}
-
-	// Write the state to the ledger
-	err = stub.PutState("test_key", []byte(strconv.Itoa(Aval)))				//making a test var "abc", I find it handy to read/write to it right away to test the network
-	if err != nil {
-		return nil, err
-	}
-	
-	var empty []string
-	jsonAsBytes, _ := json.Marshal(empty)								//marshal an emtpy array of strings to clear the index
-	err = stub.PutState(accountIndexStr, jsonAsBytes)
-	if err != nil {
-		return nil, err
-	}
-	
-	return nil, nil
-}
-
-// ============================================================================================================================
-// Invoke - Our entry point for Invocations
-// ============================================================================================================================
-func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	fmt.Println("invoke is running " + function)
-
-	// Handle different functions
-	if function == "init" {													//initialize the chaincode state, used as reset
-		return t.Init(stub, "init", args)
-	} else if function == "delete" {										//deletes an entity from its state
-		return t.Delete(stub, args)												//lets make sure all open trades are still valid
-	} else if function == "write" {											//writes a value to the chaincode state
-		return t.Write(stub, args)
-	} else if function == "init_account" {									//create a new account
-		return t.init_account(stub, args)
-	} else if function == "transfer_balance" {									
-		return t.transfer_balance(stub, args)										
-	}
-	fmt.Println("invoke did not find func: " + function)					//error
-
-	return nil, errors.New("Received unknown function invocation")
-}
-
-// ============================================================================================================================
-// Query - Our entry point for Queries
-// ============================================================================================================================
-func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	fmt.Println("query is running " + function)
-
-	// Handle different functions
-	if function == "read" {													//read a variable
-		return t.read(stub, args)
-	}
-	fmt.Println("query did not find func: " + function)						//error
-
-	return nil, errors.New("Received unknown function query")
-}
-
-// ============================================================================================================================
-// Read - read a variable from chaincode state
-// ============================================================================================================================
-func (t *SimpleChaincode) read(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var name, jsonResp string
-	var err error
-
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting name of the var to query")
-	}
-
-	name = args[0]
-	valAsbytes, err := stub.GetState(name)									//get the var from chaincode state
-	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + name + "\"}"
-		return nil, errors.New(jsonResp)
-	}
-
-	return valAsbytes, nil													//send it onward
-}
-
-// ============================================================================================================================
-// Delete - remove a key/value pair from state
-// ============================================================================================================================
-func (t *SimpleChaincode) Delete(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
-	}
-	
-	name := args[0]
-	err := stub.DelState(name)													//remove the key from chaincode state
-	if err != nil {
-		return nil, errors.New("Failed to delete state")
-	}
-
-	//get the marble index
-	accountsAsBytes, err := stub.GetState(accountIndexStr)
-	if err != nil {
-		return nil, errors.New("Failed to get marble index")
-	}
-	var accountIndex []string
-	json.Unmarshal(accountsAsBytes, &accountIndex)								//un stringify it aka JSON.parse()
-	
-	//remove marble from index
-	for i,val := range accountIndex{
-		fmt.Println(strconv.Itoa(i) + " - looking at " + val + " for " + name)
-		if val == name{															//find the correct account
-			fmt.Println("found account")
-			accountIndex = append(accountIndex[:i], accountIndex[i+1:]...)			//remove it
-			for x:= range accountIndex{											//debug prints...
-				fmt.Println(string(x) + " - " + accountIndex[x])
-			}
-			break
-		}
-	}
-	jsonAsBytes, _ := json.Marshal(accountIndex)									//save new index
-	err = stub.PutState(accountIndexStr, jsonAsBytes)
-	return nil, nil
-}
-
-// ============================================================================================================================
-// Write - write variable into chaincode state
-// ============================================================================================================================
-func (t *SimpleChaincode) Write(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var name, value string // Entities
-	var err error
-	fmt.Println("running write()")
-
-	if len(args) != 2 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 2. name of the variable and value to set")
-	}
-
-	name = args[0]														
-	value = args[1]
-	err = stub.PutState(name, []byte(value))					
-	if err != nil {
-		return nil, err
-	}
-	return nil, nil
-}
-
-// ============================================================================================================================
-// Init account - create a new account, store into chaincode state
-// ============================================================================================================================
-func (t *SimpleChaincode) init_account(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var err error
-
-	//       0        1      2      3
-	// "accountNo", "bob", "USD", "3500"
-	if len(args) != 4 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 4")
-	}
-
-	//input sanitation
-	fmt.Println("- start init acount")
-	if len(args[0]) <= 0 {
-		return nil, errors.New("1st argument must be a non-empty string")
-	}
-	if len(args[1]) <= 0 {
-		return nil, errors.New("2nd argument must be a non-empty string")
-	}
-	if len(args[2]) <= 0 {
-		return nil, errors.New("3rd argument must be a non-empty string")
-	}
-	if len(args[3]) <= 0 {
-		return nil, errors.New("3rd argument must be a non-empty string")
-	}
-
-	accountNo := args[0]
-
-	legalEntity := strings.ToLower(args[1])
-
-	currency := args[2]
-
-	ammount, err := strconv.ParseFloat(args[3],64)
-	if err != nil {
-		return nil, errors.New("4rd argument must be a numeric string")
-	}
-
-	//check if account already exists
-	accountAsBytes, err := stub.GetState(accountNo)
-	if err != nil {
-		return nil, errors.New("Failed to get account number")
-	}
-	res := Account{}
-	json.Unmarshal(accountAsBytes, &res)
-	if res.AccountNo == accountNo{
-		fmt.Println("This account arleady exists: " + accountNo)
-		fmt.Println(res);
-		return nil, errors.New("This account arleady exists")			
-	}
-	amountStr := strconv.FormatFloat(ammount, 'E', -1, 64)
-	//build the account json string manually
-	str := `{"accountno": "` + accountNo + `", "legalentity": "` + legalEntity + `", "currency": "` + currency + `", "balance": "` + amountStr + `"}`
-	err = stub.PutState(accountNo, []byte(str))							
-	if err != nil {
-		return nil, err
-	}
-		
-	//get the account index
-	accountsAsBytes, err := stub.GetState(accountIndexStr)
-	if err != nil {
-		return nil, errors.New("Failed to get account index")
-	}
-	var accountIndex []string
-	json.Unmarshal(accountsAsBytes, &accountIndex)							
-	
-	//append
-	accountIndex = append(accountIndex, accountNo)						
-	fmt.Println("! account index: ", accountIndex)
-	jsonAsBytes, _ := json.Marshal(accountIndex)
-	err = stub.PutState(accountIndexStr, jsonAsBytes)						
-
-	fmt.Println("- end init account")
-	return nil, nil
-}
-
-// ============================================================================================================================
-// transfer the balance between accounts
-// ============================================================================================================================
-func (t *SimpleChaincode) transfer_balance(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var err error
-	var newAmountA, newAmountB float64
-	//       0           1         2
-	// "accountA", "accountB", "100.20"
-	if len(args) < 3 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 3")
-	}
-	
-	fmt.Println("- start transfer_balance")
-	fmt.Println(args[0] + " to " + args[1])
-
-	amount,err := strconv.ParseFloat(args[2], 64)
-	if err != nil {
-		return nil, errors.New("3rd argument must be a numeric string")
-	}
-
-	accountAAsBytes, err := stub.GetState(args[0])
-	if err != nil {
-		return nil, errors.New("Failed to get the first account")
-	}
-	resA := Account{}
-	json.Unmarshal(accountAAsBytes, &resA)										//un stringify it aka JSON.parse()
-	
-	accountBAsBytes, err := stub.GetState(args[1])
-	if err != nil {
-		return nil, errors.New("Failed to get the second account")
-	}
-	resB := Account{}
-	json.Unmarshal(accountBAsBytes, &resB)											
-	
-	BalanceA,err := strconv.ParseFloat(resA.Balance, 64)
-	if err != nil {
-		return nil, err
-	}
-	BalanceB,err := strconv.ParseFloat(resB.Balance, 64)
-	if err != nil {
-		return nil, err
-	}
-
-	if (BalanceA - amount) < 0 {
-		return nil, errors.New(args[0] + " doesn't have enough balance to complete transaction")
-	}
-
-	newAmountA = BalanceA - amount
-	newAmountB =  BalanceB + amount
-	newAmountStrA := strconv.FormatFloat(newAmountA, 'E', -1, 64)
-	newAmountStrB := strconv.FormatFloat(newAmountB, 'E', -1, 64)
-
-	resA.Balance = newAmountStrA
-	resB.Balance = newAmountStrB
-
-	jsonAAsBytes, _ := json.Marshal(resA)
-	err = stub.PutState(args[0], jsonAAsBytes)								
-	if err != nil {
-		return nil, err
-	}
-
-	jsonBAsBytes, _ := json.Marshal(resB)
-	err = stub.PutState(args[1], jsonBAsBytes)								
-	if err != nil {
-		return nil, err
-	}
-	
-	fmt.Println("- end transfer_balance")
-	return nil, nil
-}
\ No newline at end of file
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sreedhar310/learn-chaincode/builder"
+	"github.com/sreedhar310/learn-chaincode/fees"
+	"github.com/sreedhar310/learn-chaincode/idempotency"
+	"github.com/sreedhar310/learn-chaincode/identity"
+	"github.com/sreedhar310/learn-chaincode/ledger"
+	"github.com/sreedhar310/learn-chaincode/validate"
+)
+
+// SimpleChaincode example simple Chaincode implementation
+type SimpleChaincode struct {
+}
+
+// Accounts are stored under their account number. Every other record is stored under a key containing ':', which
+// account numbers can't contain, so opening an account can never take or overwrite one.
+var accountIndexStr = "index:accounts"
+
+// legacyAccountIndexStr is where the index was kept before, read until the index is next saved under accountIndexStr
+var legacyAccountIndexStr = "_accountindex"
+
+type Account struct{
+	AccountNo string `json:"accountno"`	
+	LegalEntity string `json:"legalentity"`
+	Currency string `json:"currency"`				
+	Balance string `json:"balance"`
+	Delegates []Delegate `json:"delegates,omitempty"`
+	Status string `json:"status,omitempty"`
+	BlockCredits bool `json:"blockcredits,omitempty"`
+	StatusReason string `json:"statusreason,omitempty"`
+	CreditLimit string `json:"creditlimit,omitempty"`
+	OverdraftRate string `json:"overdraftrate,omitempty"`
+	InterestCharged int64 `json:"interestcharged,omitempty"`
+	OverdraftAccrued string `json:"overdraftaccrued,omitempty"`
+	Held string `json:"held,omitempty"`
+	InterestProduct string `json:"interestproduct,omitempty"`
+	DepositRate string `json:"depositrate,omitempty"`
+	DayCount string `json:"daycount,omitempty"`
+	InterestAccrued string `json:"interestaccrued,omitempty"`
+	AccruedTo int64 `json:"accruedto,omitempty"`
+	InterestPosted int64 `json:"interestposted,omitempty"`
+	Parent string `json:"parent,omitempty"`
+	SweepThreshold string `json:"sweepthreshold,omitempty"`
+}
+
+// ============================================================================================================================
+// Main
+// ============================================================================================================================
+func main() {
+	err := shim.Start(new(SimpleChaincode))
+	if err != nil {
+		fmt.Printf("Error starting Simple chaincode: %s", err)
+	}
+}
+
+// ============================================================================================================================
+// Init - set up the account index, the supply and the first roles. Balances, journals and ledger entries are never
+// reset, so once there is an index or a supply the chaincode is in use and Init refuses to run again.
+// ============================================================================================================================
+func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	var Aval int
+	var err error
+
+	//    0        1         2        3         4
+	// "100", "alice", "admin", "bob", "fx_oracle"
+	if len(args) == 0 || len(args) % 2 != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1, followed by pairs of name and role")
+	}
+	for _, key := range []string{accountIndexStr, legacyAccountIndexStr, totalSupplyStr} {
+		existing, err := stub.GetState(key)
+		if err != nil {
+			return nil, errors.New("Failed to get " + key)
+		}
+		if existing != nil {
+			return nil, errors.New("The chaincode is already initialised, re-initialising would orphan its accounts")
+		}
+	}
+
+	// Initialize the chaincode
+	Aval, err = strconv.Atoi(args[0])
+	if err != nil {
+		return nil, errors.New("Expecting integer value for asset holding")
+	}
+
+	// Write the state to the ledger
+	err = stub.PutState("test_key", []byte(strconv.Itoa(Aval)))				//making a test var "abc", I find it handy to read/write to it right away to test the network
+	if err != nil {
+		return nil, err
+	}
+	
+	var empty []string
+	jsonAsBytes, _ := json.Marshal(empty)								//marshal an emtpy array of strings to clear the index
+	err = stub.PutState(accountIndexStr, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+	err = t.save_supply(stub, map[string]string{})						//the supply is what the indexed accounts hold
+	if err != nil {
+		return nil, err
+	}
+
+	// save the roles of the network participants
+	for i := 1; i < len(args); i = i + 2 {
+		err = t.set_role(stub, args[i], args[i+1], true)
+		if err != nil {
+			return nil, err
+		}
+	}
+	
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Invoke - Our entry point for Invocations
+// ============================================================================================================================
+func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	fmt.Println("invoke is running " + function)
+
+	caller, err := identity.Caller(stub)
+	if err != nil {
+		return nil, errors.New("Error retrieving caller information: " + err.Error())
+	}
+
+	// Handle different functions
+	if function == "init" {													//initialize the chaincode state, refused once it is in use
+		err = t.check_role(stub, caller, ADMIN, "init")
+		if err != nil {
+			return nil, err
+		}
+		return t.Init(stub, "init", args)
+	} else if function == "init_account" {									//create a new account
+		return t.init_account(stub, caller, args)
+	} else if function == "transfer_balance" {									
+		return idempotency.Run(stub, caller, function, args, func() ([]byte, error) { return t.transfer_balance(stub, caller, args) })
+	} else if function == "grant_delegate" {								//let another identity debit an account
+		return t.grant_delegate(stub, caller, args)
+	} else if function == "revoke_delegate" {
+		return t.revoke_delegate(stub, caller, args)
+	} else if function == "grant_role" {									//admins hand out network roles
+		return t.grant_role(stub, caller, args)
+	} else if function == "revoke_role" {
+		return t.revoke_role(stub, caller, args)
+	} else if function == "set_fx_rate" {									//fx oracles publish rates
+		return t.set_fx_rate(stub, caller, args)
+	} else if function == "transfer_fx" {									//transfer between currencies
+		return idempotency.Run(stub, caller, function, args, func() ([]byte, error) { return t.transfer_fx(stub, caller, args) })
+	} else if function == "freeze_account" {								//compliance holds an account
+		return t.freeze_account(stub, caller, args)
+	} else if function == "unfreeze_account" {
+		return t.unfreeze_account(stub, caller, args)
+	} else if function == "close_account" {									//owner closes an empty account
+		return t.close_account(stub, caller, args)
+	} else if function == "set_credit_limit" {								//agree an overdraft facility
+		return t.set_credit_limit(stub, caller, args)
+	} else if function == "charge_interest" {								//charge interest on an overdraft
+		return t.charge_interest(stub, args)
+	} else if function == "place_hold" {									//reserve funds for a payee
+		return t.place_hold(stub, caller, args)
+	} else if function == "capture_hold" {
+		return t.capture_hold(stub, caller, args)
+	} else if function == "release_hold" {
+		return t.release_hold(stub, caller, args)
+	} else if function == "expire_holds" {									//release holds past their expiry
+		return t.expire_holds(stub, args)
+	} else if function == "create_standing_order" {						//recurring transfer
+		return t.create_standing_order(stub, caller, args)
+	} else if function == "cancel_standing_order" {
+		return t.cancel_standing_order(stub, caller, args)
+	} else if function == "run_due_payments" {								//called by the external scheduler
+		return t.run_due_payments(stub, args)
+	} else if function == "batch_transfer" {								//many transfers, all or nothing
+		return idempotency.Run(stub, caller, function, args, func() ([]byte, error) { return t.batch_transfer(stub, caller, args) })
+	} else if function == "mint" {											//issuers create money
+		return t.mint(stub, caller, args)
+	} else if function == "burn" {											//and destroy it
+		return t.burn(stub, caller, args)
+	} else if function == "reverse_transfer" {								//send a mistaken transfer back
+		return idempotency.Run(stub, caller, function, args, func() ([]byte, error) { return t.reverse_transfer(stub, caller, args) })
+	} else if function == "set_fee_rule" {									//admins set the fee schedule
+		return t.set_fee_rule(stub, caller, args)
+	} else if function == "remove_fee_rule" {
+		return t.remove_fee_rule(stub, caller, args)
+	} else if function == "set_fee_account" {								//where fees in a currency are paid
+		return t.set_fee_account(stub, caller, args)
+	} else if function == "set_interest_product" {							//deposit interest rates
+		return t.set_interest_product(stub, caller, args)
+	} else if function == "set_account_interest" {
+		return t.set_account_interest(stub, caller, args)
+	} else if function == "accrue_interest" {								//called by the external scheduler
+		return t.accrue_interest(stub, args)
+	} else if function == "set_parent" {									//group accounts under a parent
+		return t.set_parent(stub, caller, args)
+	} else if function == "set_sweep" {										//pool cash into the parent
+		return t.set_sweep(stub, caller, args)
+	} else if function == "run_sweeps" {									//called by the external scheduler
+		return t.run_sweeps(stub, args)
+	}
+	fmt.Println("invoke did not find func: " + function)					//error
+
+	return nil, errors.New("Received unknown function invocation")
+}
+
+// ============================================================================================================================
+// Query - Our entry point for Queries
+// ============================================================================================================================
+func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	fmt.Println("query is running " + function)
+
+	caller, err := identity.Caller(stub)
+	if err != nil {
+		return nil, errors.New("Error retrieving caller details: " + err.Error())
+	}
+
+	// Handle different functions
+	if function == "read" {													//read a variable
+		return t.read(stub, args)
+	} else if function == "get_delegates" {									//list who may debit an account
+		return t.get_delegates(stub, caller, args)
+	} else if function == "get_fx_rate" {									//the published rate for a pair
+		return t.get_fx_rate(stub, args)
+	} else if function == "get_statement" {									//journal entries for a date range
+		return t.get_statement(stub, caller, args)
+	} else if function == "get_trial_balance" {								//prove the ledger balances
+		return ledger.GetTrialBalance(stub)
+	} else if function == "get_available_funds" {							//balance plus credit limit
+		return t.get_available_funds(stub, caller, args)
+	} else if function == "get_holds" {										//holds placed on an account
+		return t.get_holds(stub, caller, args)
+	} else if function == "get_standing_orders" {							//standing orders paid from an account
+		return t.get_standing_orders(stub, caller, args)
+	} else if function == "get_total_supply" {								//money in circulation per currency
+		return t.get_total_supply(stub)
+	} else if function == "check_invariants" {								//prove the balances add up to the supply
+		return t.check_invariants(stub)
+	} else if function == "get_transfers" {									//transfers made by a transaction
+		return t.get_transfers(stub, caller, args)
+	} else if function == "get_fee_schedule" {								//fee rules and fee accounts
+		return t.get_fee_schedule(stub)
+	} else if function == "get_fee_report" {								//fees collected so far
+		return fees.GetReport(stub)
+	} else if function == "get_accrued_interest" {							//interest not yet posted
+		return t.get_accrued_interest(stub, caller, args)
+	} else if function == "get_consolidated_balance" {						//a group's balances by currency
+		return t.get_consolidated_balance(stub, caller, args)
+	}
+	fmt.Println("query did not find func: " + function)						//error
+
+	return nil, errors.New("Received unknown function query")
+}
+
+// ============================================================================================================================
+// Read - read a variable from chaincode state
+// ============================================================================================================================
+func (t *SimpleChaincode) read(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var name, jsonResp string
+	var err error
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting name of the var to query")
+	}
+
+	name = args[0]
+	valAsbytes, err := stub.GetState(name)									//get the var from chaincode state
+	if err != nil {
+		jsonResp = "{\"Error\":\"Failed to get state for " + name + "\"}"
+		return nil, errors.New(jsonResp)
+	}
+
+	return valAsbytes, nil													//send it onward
+}
+
+// ============================================================================================================================
+// Init account - create a new account, store into chaincode state
+// ============================================================================================================================
+func (t *SimpleChaincode) init_account(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+	var err error
+
+	//       0        1
+	// "accountNo", "USD"
+	// The legal entity is always the caller, and the account opens empty. Only an issuer can fund it, with mint.
+	if len(args) == 3 {
+		return nil, errors.New("Accounts open with a zero balance, an opening balance can only be added by an issuer with mint")
+	}
+	err = identity.CheckArgs(args, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	//input sanitation, build the account from validated fields
+	fmt.Println("- start init acount")
+	f, err := builder.NewAccount().AccountNo(args[0]).LegalEntity(caller).Currency(args[1]).Balance("0").Build()
+	if err != nil {
+		return nil, err
+	}
+	acc := Account{AccountNo: f.AccountNo, LegalEntity: f.LegalEntity, Currency: f.Currency, Balance: f.Balance}
+	accountNo := acc.AccountNo
+
+	//check if account already exists, or the number is taken by another record
+	accountAsBytes, err := stub.GetState(accountNo)
+	if err != nil {
+		return nil, errors.New("Failed to get account number")
+	}
+	if accountAsBytes != nil {
+		fmt.Println("This account arleady exists: " + accountNo)
+		return nil, errors.New("This account arleady exists")			
+	}
+	acc.Status = ACTIVE
+	err = t.save_account(stub, acc)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.journal(stub, acc.AccountNo, "", 0, 0, "opening balance")
+	if err != nil {
+		return nil, err
+	}
+		
+	//get the account index
+	accountIndex, err := t.retrieve_account_index(stub)
+	if err != nil {
+		return nil, err
+	}
+	
+	//append
+	accountIndex = append(accountIndex, Index_Entry{AccountNo: accountNo, Status: ACTIVE})
+	fmt.Println("! account index: ", accountIndex)
+	err = t.save_account_index(stub, accountIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end init account")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// get_tx_time - the transaction timestamp in unix seconds. Used instead of the local clock so that every peer
+// reaches the same decision.
+// ============================================================================================================================
+func (t *SimpleChaincode) get_tx_time(stub shim.ChaincodeStubInterface) (int64, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, errors.New("Couldn't get transaction timestamp. Error: " + err.Error())
+	}
+	return ts.Seconds, nil
+}
+
+// ============================================================================================================================
+// accrue - bring the interest an account earns or owes up to the transaction time, at the balance it has held since
+// the last accrual. It is called on an account before every change to its balance, so that balance really was held
+// throughout.
+// ============================================================================================================================
+func (t *SimpleChaincode) accrue(stub shim.ChaincodeStubInterface, acc Account) (Account, error) {
+	now, err := t.get_tx_time(stub)
+	if err != nil {
+		return acc, err
+	}
+	acc, _, err = t.accrue_deposit_interest(stub, acc, now)
+	if err != nil {
+		return acc, err
+	}
+	return accrue_overdraft_interest(acc, now)
+}
+
+// ============================================================================================================================
+// Retrieve account - get an account from chaincode state, failing if there is no account with that number
+// ============================================================================================================================
+func (t *SimpleChaincode) retrieve_account(stub shim.ChaincodeStubInterface, accountNo string) (Account, error) {
+	var acc Account
+
+	accountAsBytes, err := stub.GetState(accountNo)
+	if err != nil {
+		return acc, errors.New("Failed to get account " + accountNo)
+	}
+	err = json.Unmarshal(accountAsBytes, &acc)
+	if err != nil || acc.AccountNo != accountNo {
+		return acc, errors.New("Account " + accountNo + " does not exist")
+	}
+	return acc, nil
+}
+
+// ============================================================================================================================
+// Save account - write an account back into chaincode state
+// ============================================================================================================================
+func (t *SimpleChaincode) save_account(stub shim.ChaincodeStubInterface, acc Account) error {
+	accountAsBytes, err := json.Marshal(acc)
+	if err != nil {
+		return errors.New("Failed to convert the account record")
+	}
+	return stub.PutState(acc.AccountNo, accountAsBytes)
+}
+
+// ============================================================================================================================
+// transfer - debit one account and credit the other. The debit is in the first account's currency and the credit in
+// the second's, so they only differ for an FX transfer. Fails unless the caller may debit the first account and its
+// available funds cover the debit.
+// ============================================================================================================================
+func (t *SimpleChaincode) transfer(stub shim.ChaincodeStubInterface, caller string, resA Account, resB Account, debit float64, credit float64, memo string) error {
+	err := authorize_debit(&resA, caller, debit)
+	if err != nil {
+		return err
+	}
+	return t.move(stub, resA, resB, debit, credit, memo)
+}
+
+// ============================================================================================================================
+// move - the part of a transfer after the caller has been authorised, also used to capture holds
+// ============================================================================================================================
+func (t *SimpleChaincode) move(stub shim.ChaincodeStubInterface, resA Account, resB Account, debit float64, credit float64, memo string) error {
+	var newAmountA, newAmountB float64
+
+	err := check_debit(resA)
+	if err != nil {
+		return err
+	}
+	err = check_credit(resB)
+	if err != nil {
+		return err
+	}
+	resA, err = t.accrue(stub, resA)
+	if err != nil {
+		return err
+	}
+	resB, err = t.accrue(stub, resB)
+	if err != nil {
+		return err
+	}
+	
+	BalanceA,err := strconv.ParseFloat(resA.Balance, 64)
+	if err != nil {
+		return err
+	}
+	BalanceB,err := strconv.ParseFloat(resB.Balance, 64)
+	if err != nil {
+		return err
+	}
+
+	AvailableA, err := available_funds(resA)
+	if err != nil {
+		return err
+	}
+	if debit > AvailableA {
+		return errors.New(resA.AccountNo + " doesn't have enough available funds to complete transaction")
+	}
+
+	newAmountA = BalanceA - debit
+	newAmountB =  BalanceB + credit
+	resA.Balance = strconv.FormatFloat(newAmountA, 'E', -1, 64)
+	resB.Balance = strconv.FormatFloat(newAmountB, 'E', -1, 64)
+
+	err = t.save_account(stub, resA)
+	if err != nil {
+		return err
+	}
+	err = t.save_account(stub, resB)
+	if err != nil {
+		return err
+	}
+
+	err = t.journal(stub, resA.AccountNo, resB.AccountNo, -debit, newAmountA, memo)
+	if err != nil {
+		return err
+	}
+	err = t.journal(stub, resB.AccountNo, resA.AccountNo, credit, newAmountB, memo)
+	if err != nil {
+		return err
+	}
+	err = t.record_transfer(stub, resA, resB, debit, credit, memo)
+	if err != nil {
+		return err
+	}
+
+	//post to the general ledger, going through the fx position when the currencies differ
+	if resA.Currency == resB.Currency {
+		return ledger.Post(stub, memo,
+			ledger.Debit(ledger.Customer(resA.AccountNo), resA.Currency, debit),
+			ledger.Credit(ledger.Customer(resB.AccountNo), resB.Currency, credit))
+	}
+	//the fx position isn't a customer account, so money passing through it leaves one currency's supply for the other's
+	err = t.adjust_supply(stub, resA.Currency, -debit)
+	if err != nil {
+		return err
+	}
+	err = t.adjust_supply(stub, resB.Currency, credit)
+	if err != nil {
+		return err
+	}
+	return ledger.Post(stub, memo,
+		ledger.Debit(ledger.Customer(resA.AccountNo), resA.Currency, debit),
+		ledger.Credit(ledger.FXPosition, resA.Currency, debit),
+		ledger.Debit(ledger.FXPosition, resB.Currency, credit),
+		ledger.Credit(ledger.Customer(resB.AccountNo), resB.Currency, credit))
+}
+
+// ============================================================================================================================
+// charge - debit an account for something owed to the network, such as interest, and credit the ledger account that
+// earns it. A charge needs no authorisation from the owner and may take the balance past the credit limit. The money
+// leaves the customer accounts, so it comes off the total supply.
+// ============================================================================================================================
+func (t *SimpleChaincode) charge(stub shim.ChaincodeStubInterface, acc Account, amount float64, income string, memo string) (Account, error) {
+	if account_status(acc) == CLOSED {
+		return acc, errors.New("Account " + acc.AccountNo + " is closed")
+	}
+	acc, err := t.accrue(stub, acc)
+	if err != nil {
+		return acc, err
+	}
+
+	balance, err := strconv.ParseFloat(acc.Balance, 64)
+	if err != nil {
+		return acc, err
+	}
+	balance = balance - amount
+	acc.Balance = strconv.FormatFloat(balance, 'E', -1, 64)
+
+	err = t.save_account(stub, acc)
+	if err != nil {
+		return acc, err
+	}
+	err = t.journal(stub, acc.AccountNo, "", -amount, balance, memo)
+	if err != nil {
+		return acc, err
+	}
+	err = t.adjust_supply(stub, acc.Currency, -amount)
+	if err != nil {
+		return acc, err
+	}
+	return acc, ledger.Post(stub, memo + " " + acc.AccountNo,
+		ledger.Debit(ledger.Customer(acc.AccountNo), acc.Currency, amount),
+		ledger.Credit(income, acc.Currency, amount))
+}
+
+// ============================================================================================================================
+// transfer the balance between accounts in the same currency. Only the owner of the first account, or one of its
+// delegates, can make it.
+// ============================================================================================================================
+func (t *SimpleChaincode) transfer_balance(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+	var err error
+	//       0           1         2
+	// "accountA", "accountB", "100.20"
+	err = identity.CheckArgs(args, 3)
+	if err != nil {
+		return nil, err
+	}
+	
+	fmt.Println("- start transfer_balance")
+	fmt.Println(args[0] + " to " + args[1])
+
+	amount, err := validate.Money(args[2])
+	if err != nil {
+		return nil, errors.New("3rd argument must be a positive amount with at most two decimal places")
+	}
+	if args[0] == args[1] {
+		return nil, errors.New("Can't transfer from an account to itself")
+	}
+
+	resA, err := t.retrieve_account(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	resB, err := t.retrieve_account(stub, args[1])
+	if err != nil {
+		return nil, err
+	}
+	if resA.Currency != resB.Currency {
+		return nil, errors.New(fmt.Sprintf("Currency mismatch. %v is in %v and %v is in %v, use transfer_fx", resA.AccountNo, resA.Currency, resB.AccountNo, resB.Currency))
+	}
+
+	err = t.transfer(stub, caller, resA, resB, amount, amount, "transfer")
+	if err != nil {
+		return nil, err
+	}
+	err = t.collect_fee(stub, "transfer_balance", resA.AccountNo, amount)
+	if err != nil {
+		return nil, err
+	}
+	
+	fmt.Println("- end transfer_balance")
+	return nil, nil
+}
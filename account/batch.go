@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sreedhar310/learn-chaincode/identity"
+	"github.com/sreedhar310/learn-chaincode/ledger"
+	"github.com/sreedhar310/learn-chaincode/validate"
+)
+
+// ============================================================================================================================
+// Batch transfers - a list of legs applied all together or not at all. The legs are run in order against working
+// copies of the accounts, so a debit can be funded by a credit earlier in the batch, and nothing is written unless
+// every leg succeeds. Each leg follows transfer_balance rules: same currency, the caller may debit the source, and the
+// source's available funds cover it at that point in the batch.
+// ============================================================================================================================
+const MAX_BATCH_LEGS = 200
+
+type Batch_Leg struct{
+	From string `json:"from"`
+	To string `json:"to"`
+	Amount string `json:"amount"`
+	Memo string `json:"memo,omitempty"`
+}
+
+type Leg_Result struct{
+	Leg int `json:"leg"`
+	From string `json:"from"`
+	To string `json:"to"`
+	Amount string `json:"amount"`
+	Ok bool `json:"ok"`
+	Reason string `json:"reason,omitempty"`
+	FromBalance string `json:"frombalance,omitempty"`
+	ToBalance string `json:"tobalance,omitempty"`
+}
+
+type Batch_Result struct{
+	Applied bool `json:"applied"`
+	Legs []Leg_Result `json:"legs"`
+}
+
+// Leg_State - the two accounts of a leg as they stood just after it was applied, for its journal and transfer record
+type Leg_State struct{
+	From Account
+	To Account
+}
+
+// ============================================================================================================================
+// run_leg - apply one leg to the working copies, returning why it can't be applied if it can't
+// ============================================================================================================================
+func (t *SimpleChaincode) run_leg(stub shim.ChaincodeStubInterface, caller string, working map[string]*Account, leg Batch_Leg, result *Leg_Result) error {
+	amount, err := validate.Money(leg.Amount)
+	if err != nil {
+		return errors.New("Amount must be a positive amount with at most two decimal places")
+	}
+	if leg.From == leg.To {
+		return errors.New("Can't transfer from an account to itself")
+	}
+
+	for _, accountNo := range []string{leg.From, leg.To} {
+		if _, ok := working[accountNo]; !ok {
+			acc, err := t.retrieve_account(stub, accountNo)
+			if err != nil {
+				return err
+			}
+			acc, err = t.accrue(stub, acc)
+			if err != nil {
+				return err
+			}
+			working[accountNo] = &acc
+		}
+	}
+	src := working[leg.From]
+	dst := working[leg.To]
+
+	if src.Currency != dst.Currency {
+		return errors.New(fmt.Sprintf("Currency mismatch. %v is in %v and %v is in %v", src.AccountNo, src.Currency, dst.AccountNo, dst.Currency))
+	}
+	if err = check_debit(*src); err != nil {
+		return err
+	}
+	if err = check_credit(*dst); err != nil {
+		return err
+	}
+	if err = authorize_debit(src, caller, amount); err != nil {
+		return err
+	}
+
+	available, err := available_funds(*src)
+	if err != nil {
+		return err
+	}
+	if amount > available {
+		return errors.New(src.AccountNo + " doesn't have enough available funds at this point in the batch")
+	}
+
+	srcBalance, _ := strconv.ParseFloat(src.Balance, 64)
+	dstBalance, _ := strconv.ParseFloat(dst.Balance, 64)
+	src.Balance = strconv.FormatFloat(srcBalance - amount, 'E', -1, 64)
+	dst.Balance = strconv.FormatFloat(dstBalance + amount, 'E', -1, 64)
+
+	result.Amount = strconv.FormatFloat(amount, 'E', -1, 64)
+	result.FromBalance = src.Balance
+	result.ToBalance = dst.Balance
+	return nil
+}
+
+// ============================================================================================================================
+// Batch transfer - takes a JSON list of legs and returns the result of each. If any leg fails nothing is applied and
+// the batch fails with the results, which say which legs failed and why. Failing rather than returning the results
+// means an idempotency key isn't used up, so the same batch can be retried once it would succeed.
+// ============================================================================================================================
+func (t *SimpleChaincode) batch_transfer(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//       0
+	// [{"from":"accountA","to":"accountB","amount":"100.20","memo":"salary"}, ...]
+
+	err := identity.CheckArgs(args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	var legs []Batch_Leg
+	err = json.Unmarshal([]byte(args[0]), &legs)
+	if err != nil {
+		return nil, errors.New("Legs must be a JSON list of {from, to, amount, memo}")
+	}
+	if len(legs) == 0 || len(legs) > MAX_BATCH_LEGS {
+		return nil, errors.New(fmt.Sprintf("A batch needs between 1 and %v legs", MAX_BATCH_LEGS))
+	}
+
+	working := map[string]*Account{}
+	batch := Batch_Result{Applied: true}
+	var states []Leg_State
+
+	for i, leg := range legs {
+		result := Leg_Result{Leg: i, From: leg.From, To: leg.To, Amount: leg.Amount, Ok: true}
+		err = t.run_leg(stub, caller, working, leg, &result)
+		if err != nil {
+			result.Ok = false
+			result.Reason = err.Error()
+			batch.Applied = false
+		} else {
+			states = append(states, Leg_State{From: *working[leg.From], To: *working[leg.To]})
+		}
+		batch.Legs = append(batch.Legs, result)
+	}
+
+	if !batch.Applied {
+		resultAsBytes, err := json.Marshal(batch)
+		if err != nil {
+			return nil, errors.New("Batch not applied")
+		}
+		return nil, errors.New("Batch not applied: " + string(resultAsBytes))
+	}
+
+	for _, acc := range working {
+		err = t.save_account(stub, *acc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i, leg := range legs {
+		state := states[i]
+		amount, _ := strconv.ParseFloat(batch.Legs[i].Amount, 64)
+		fromBalance, _ := strconv.ParseFloat(state.From.Balance, 64)
+		toBalance, _ := strconv.ParseFloat(state.To.Balance, 64)
+
+		memo := "batch transfer"
+		if leg.Memo != "" {
+			memo = memo + ": " + leg.Memo
+		}
+
+		err = t.journal(stub, leg.From, leg.To, -amount, fromBalance, memo)
+		if err != nil {
+			return nil, err
+		}
+		err = t.journal(stub, leg.To, leg.From, amount, toBalance, memo)
+		if err != nil {
+			return nil, err
+		}
+		err = t.record_transfer(stub, state.From, state.To, amount, amount, memo)
+		if err != nil {
+			return nil, err
+		}
+		currency := state.From.Currency
+		err = ledger.Post(stub, memo,
+			ledger.Debit(ledger.Customer(leg.From), currency, amount),
+			ledger.Credit(ledger.Customer(leg.To), currency, amount))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(batch)
+}
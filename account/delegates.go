@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sreedhar310/learn-chaincode/identity"
+	"github.com/sreedhar310/learn-chaincode/validate"
+)
+
+// ============================================================================================================================
+// Delegate - an identity the owner lets debit their account. With a limit the delegate can debit at most that much in
+// total, tracked in Spent. Without one the delegate can debit as much as the owner could.
+// ============================================================================================================================
+type Delegate struct{
+	Name string `json:"name"`
+	Limit string `json:"limit,omitempty"`
+	Spent string `json:"spent"`
+}
+
+// ============================================================================================================================
+// is_owner - true if the caller is the legal entity that owns the account
+// ============================================================================================================================
+func is_owner(acc Account, caller string) bool {
+	return acc.LegalEntity == strings.ToLower(caller)
+}
+
+func find_delegate(acc Account, name string) int {
+	for i, d := range acc.Delegates {
+		if d.Name == strings.ToLower(name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// ============================================================================================================================
+// authorize_debit - checks the caller may take amount out of the account. A delegate's spending is added to the
+// account passed in, so it is stored when the account is saved.
+// ============================================================================================================================
+func authorize_debit(acc *Account, caller string, amount float64) error {
+	if is_owner(*acc, caller) {
+		return nil
+	}
+
+	i := find_delegate(*acc, caller)
+	if i < 0 {
+		return errors.New(fmt.Sprintf("Permission Denied. transfer_balance. %v !== %v", caller, acc.LegalEntity))
+	}
+
+	d := &acc.Delegates[i]
+	spent, err := strconv.ParseFloat(d.Spent, 64)
+	if err != nil {
+		return errors.New("Corrupt delegate record for " + d.Name)
+	}
+
+	if d.Limit != "" {
+		limit, err := strconv.ParseFloat(d.Limit, 64)
+		if err != nil {
+			return errors.New("Corrupt delegate record for " + d.Name)
+		}
+		if spent + amount > limit {
+			return errors.New(fmt.Sprintf("Permission Denied. transfer_balance. %v would exceed the delegate limit of %v", caller, d.Limit))
+		}
+	}
+
+	d.Spent = strconv.FormatFloat(spent + amount, 'E', -1, 64)
+	return nil
+}
+
+// ============================================================================================================================
+// refund_delegate - gives back to a delegate's spending an amount authorised for a debit that never happened, such as
+// the uncaptured part of a hold they placed. Nothing is given back to the owner, or to a delegate since revoked.
+// ============================================================================================================================
+func refund_delegate(acc *Account, name string, amount float64) error {
+	if is_owner(*acc, name) {
+		return nil
+	}
+	i := find_delegate(*acc, name)
+	if i < 0 {
+		return nil
+	}
+
+	d := &acc.Delegates[i]
+	spent, err := strconv.ParseFloat(d.Spent, 64)
+	if err != nil {
+		return errors.New("Corrupt delegate record for " + d.Name)
+	}
+	spent = spent - amount
+	if spent < 0 {
+		spent = 0
+	}
+	d.Spent = strconv.FormatFloat(spent, 'E', -1, 64)
+	return nil
+}
+
+// ============================================================================================================================
+// Grant delegate - let another identity debit an account, optionally up to a limit. Granting an existing delegate
+// again replaces their limit but keeps what they have already spent.
+// ============================================================================================================================
+func (t *SimpleChaincode) grant_delegate(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//       0            1          2
+	// "accountNo", "alice", "500" (optional)
+
+	if len(args) != 2 && len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2 or 3")
+	}
+
+	acc, err := t.retrieve_account(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if !is_owner(acc, caller) {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. grant_delegate. %v !== %v", caller, acc.LegalEntity))
+	}
+
+	err = validate.Name(args[1])
+	if err != nil {
+		return nil, errors.New("Invalid delegate: " + err.Error())
+	}
+	name := strings.ToLower(args[1])
+	if name == acc.LegalEntity {
+		return nil, errors.New("The owner can't be a delegate of their own account")
+	}
+
+	limit := ""
+	if len(args) == 3 {
+		n, err := validate.Money(args[2])
+		if err != nil {
+			return nil, errors.New("Invalid limit: " + err.Error())
+		}
+		limit = strconv.FormatFloat(n, 'E', -1, 64)
+	}
+
+	i := find_delegate(acc, name)
+	if i < 0 {
+		acc.Delegates = append(acc.Delegates, Delegate{Name: name, Limit: limit, Spent: strconv.FormatFloat(0, 'E', -1, 64)})
+	} else {
+		acc.Delegates[i].Limit = limit
+	}
+
+	err = t.save_account(stub, acc)
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Revoke delegate - stop a delegate debiting an account
+// ============================================================================================================================
+func (t *SimpleChaincode) revoke_delegate(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//       0            1
+	// "accountNo", "alice"
+
+	err := identity.CheckArgs(args, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	acc, err := t.retrieve_account(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if !is_owner(acc, caller) {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. revoke_delegate. %v !== %v", caller, acc.LegalEntity))
+	}
+
+	i := find_delegate(acc, args[1])
+	if i < 0 {
+		return nil, errors.New(args[1] + " is not a delegate of account " + acc.AccountNo)
+	}
+	acc.Delegates = append(acc.Delegates[:i], acc.Delegates[i+1:]...)
+
+	err = t.save_account(stub, acc)
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Get delegates - list the delegates of an account. Visible to the owner and the delegates themselves.
+// ============================================================================================================================
+func (t *SimpleChaincode) get_delegates(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//       0
+	// "accountNo"
+
+	err := identity.CheckArgs(args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	acc, err := t.retrieve_account(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if !is_owner(acc, caller) && find_delegate(acc, caller) < 0 {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. get_delegates. %v !== %v", caller, acc.LegalEntity))
+	}
+
+	if acc.Delegates == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(acc.Delegates)
+}
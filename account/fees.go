@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sreedhar310/learn-chaincode/fees"
+	"github.com/sreedhar310/learn-chaincode/identity"
+	"github.com/sreedhar310/learn-chaincode/ledger"
+)
+
+// ============================================================================================================================
+// Fees - admins set a fee schedule per operation and currency, and designate the account fees in each currency are
+// paid into. The fee is paid by the account being debited, on top of the amount, in the same transaction, so either
+// both go through or neither does. Fees aren't refunded when a transfer is reversed.
+// ============================================================================================================================
+
+// feeOperations - the operations collect_fee is called for, the only ones a fee rule can be set on
+var feeOperations = []string{"transfer_balance", "transfer_fx"}
+
+// ============================================================================================================================
+// collect_fee - pay the fee for an operation on an amount from an account into the fee account, if one is due
+// ============================================================================================================================
+func (t *SimpleChaincode) collect_fee(stub shim.ChaincodeStubInterface, operation string, accountNo string, amount float64) error {
+	payer, err := t.retrieve_account(stub, accountNo)
+	if err != nil {
+		return err
+	}
+	fee, feeAccountNo, err := fees.Quote(stub, operation, payer.Currency, amount)
+	if err != nil {
+		return err
+	}
+	if fee <= 0 || feeAccountNo == payer.AccountNo {
+		return nil
+	}
+
+	feeAccount, err := t.retrieve_account(stub, feeAccountNo)
+	if err != nil {
+		return errors.New("Fee account unavailable: " + err.Error())
+	}
+	err = check_debit(payer)
+	if err != nil {
+		return err
+	}
+	err = check_credit(feeAccount)
+	if err != nil {
+		return errors.New("Fee account unavailable: " + err.Error())
+	}
+
+	payer, err = t.accrue(stub, payer)
+	if err != nil {
+		return err
+	}
+	feeAccount, err = t.accrue(stub, feeAccount)
+	if err != nil {
+		return err
+	}
+
+	available, err := available_funds(payer)
+	if err != nil {
+		return err
+	}
+	if fee > available {
+		return errors.New(fmt.Sprintf("%v doesn't have enough available funds to pay the %v fee of %v", payer.AccountNo, operation, fee))
+	}
+
+	payerBalance, _ := strconv.ParseFloat(payer.Balance, 64)
+	feeBalance, _ := strconv.ParseFloat(feeAccount.Balance, 64)
+	payerBalance = payerBalance - fee
+	feeBalance = feeBalance + fee
+	payer.Balance = strconv.FormatFloat(payerBalance, 'E', -1, 64)
+	feeAccount.Balance = strconv.FormatFloat(feeBalance, 'E', -1, 64)
+
+	err = t.save_account(stub, payer)
+	if err != nil {
+		return err
+	}
+	err = t.save_account(stub, feeAccount)
+	if err != nil {
+		return err
+	}
+
+	memo := operation + " fee"
+	err = t.journal(stub, payer.AccountNo, feeAccount.AccountNo, -fee, payerBalance, memo)
+	if err != nil {
+		return err
+	}
+	err = t.journal(stub, feeAccount.AccountNo, payer.AccountNo, fee, feeBalance, memo)
+	if err != nil {
+		return err
+	}
+	err = ledger.Post(stub, memo + " " + payer.AccountNo,
+		ledger.Debit(ledger.Customer(payer.AccountNo), payer.Currency, fee),
+		ledger.Credit(ledger.Customer(feeAccount.AccountNo), payer.Currency, fee))
+	if err != nil {
+		return err
+	}
+	return fees.Collected(stub, operation, payer.Currency, fee)
+}
+
+// ============================================================================================================================
+// Set fee rule - charge a fee for an operation in a currency. Admins only.
+// ============================================================================================================================
+func (t *SimpleChaincode) set_fee_rule(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//         0             1      2       3       4     5
+	// "transfer_balance", "USD", "0.5", "0.001", "1", "25"
+
+	err := identity.CheckArgs(args, 6)
+	if err != nil {
+		return nil, err
+	}
+	err = t.check_role(stub, caller, ADMIN, "set_fee_rule")
+	if err != nil {
+		return nil, err
+	}
+	rule, err := fees.ParseRule(args, feeOperations)
+	if err != nil {
+		return nil, err
+	}
+	return nil, fees.SetRule(stub, rule)
+}
+
+// ============================================================================================================================
+// Remove fee rule - make an operation free again in a currency. Admins only.
+// ============================================================================================================================
+func (t *SimpleChaincode) remove_fee_rule(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//         0             1
+	// "transfer_balance", "USD"
+
+	err := identity.CheckArgs(args, 2)
+	if err != nil {
+		return nil, err
+	}
+	err = t.check_role(stub, caller, ADMIN, "remove_fee_rule")
+	if err != nil {
+		return nil, err
+	}
+	return nil, fees.RemoveRule(stub, args[0], args[1])
+}
+
+// ============================================================================================================================
+// Set fee account - designate the account fees in its currency are paid into. Admins only.
+// ============================================================================================================================
+func (t *SimpleChaincode) set_fee_account(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//       0
+	// "accountNo"
+
+	err := identity.CheckArgs(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	err = t.check_role(stub, caller, ADMIN, "set_fee_account")
+	if err != nil {
+		return nil, err
+	}
+
+	acc, err := t.retrieve_account(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if account_status(acc) != ACTIVE {
+		return nil, errors.New("Account " + acc.AccountNo + " isn't active")
+	}
+	return nil, fees.SetAccount(stub, acc.Currency, acc.AccountNo)
+}
+
+// ============================================================================================================================
+// Get fee schedule - the fee rules and fee accounts
+// ============================================================================================================================
+func (t *SimpleChaincode) get_fee_schedule(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	schedule, err := fees.GetSchedule(stub)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(schedule)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sreedhar310/learn-chaincode/identity"
+	"github.com/sreedhar310/learn-chaincode/validate"
+)
+
+// ============================================================================================================================
+// FX Rate - the number of units of To one unit of From buys, as last published by an FX oracle. Timestamp is the
+// transaction time of the update, in unix seconds.
+// ============================================================================================================================
+type FX_Rate struct{
+	From string `json:"from"`
+	To string `json:"to"`
+	Rate string `json:"rate"`
+	Timestamp int64 `json:"timestamp"`
+	Oracle string `json:"oracle"`
+}
+
+// FX_MAX_RATE_AGE is how old, in seconds, a rate may be before transfer_fx refuses to use it
+const FX_MAX_RATE_AGE = 15 * 60
+
+func fx_rate_key(from string, to string) string {
+	return "fxrate:" + from + ":" + to
+}
+
+func (t *SimpleChaincode) retrieve_fx_rate(stub shim.ChaincodeStubInterface, from string, to string) (FX_Rate, error) {
+	var rate FX_Rate
+
+	rateAsBytes, err := stub.GetState(fx_rate_key(from, to))
+	if err != nil {
+		return rate, errors.New("Failed to get the " + from + "/" + to + " rate")
+	}
+	if rateAsBytes == nil {
+		return rate, errors.New("No " + from + "/" + to + " rate has been published")
+	}
+	err = json.Unmarshal(rateAsBytes, &rate)
+	if err != nil {
+		return rate, errors.New("Corrupt " + from + "/" + to + " rate record")
+	}
+	return rate, nil
+}
+
+// ============================================================================================================================
+// Set FX rate - publish the rate for a currency pair. FX oracles only.
+// ============================================================================================================================
+func (t *SimpleChaincode) set_fx_rate(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//    0      1       2
+	// "EUR", "USD", "1.0842"
+
+	err := identity.CheckArgs(args, 3)
+	if err != nil {
+		return nil, err
+	}
+	err = t.check_role(stub, caller, FX_ORACLE, "set_fx_rate")
+	if err != nil {
+		return nil, err
+	}
+
+	if err = validate.Currency(args[0]); err != nil {
+		return nil, err
+	}
+	if err = validate.Currency(args[1]); err != nil {
+		return nil, err
+	}
+	if args[0] == args[1] {
+		return nil, errors.New("A rate needs two different currencies")
+	}
+	rate, err := validate.Amount(args[2])
+	if err != nil {
+		return nil, errors.New("Invalid rate: " + err.Error())
+	}
+
+	now, err := t.get_tx_time(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	rateAsBytes, _ := json.Marshal(FX_Rate{From: args[0], To: args[1], Rate: strconv.FormatFloat(rate, 'E', -1, 64), Timestamp: now, Oracle: caller})
+	err = stub.PutState(fx_rate_key(args[0], args[1]), rateAsBytes)
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Get FX rate - the published rate for a currency pair
+// ============================================================================================================================
+func (t *SimpleChaincode) get_fx_rate(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//    0      1
+	// "EUR", "USD"
+
+	err := identity.CheckArgs(args, 2)
+	if err != nil {
+		return nil, err
+	}
+	rate, err := t.retrieve_fx_rate(stub, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(rate)
+}
+
+// ============================================================================================================================
+// Transfer FX - transfer between accounts held in different currencies. The amount is in the first account's currency
+// and is converted at the published rate, which must be no older than FX_MAX_RATE_AGE.
+// ============================================================================================================================
+func (t *SimpleChaincode) transfer_fx(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//       0           1         2
+	// "accountA", "accountB", "100.20"
+
+	err := identity.CheckArgs(args, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	amount, err := validate.Money(args[2])
+	if err != nil {
+		return nil, errors.New("3rd argument must be a positive amount with at most two decimal places")
+	}
+	if args[0] == args[1] {
+		return nil, errors.New("Can't transfer from an account to itself")
+	}
+
+	resA, err := t.retrieve_account(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	resB, err := t.retrieve_account(stub, args[1])
+	if err != nil {
+		return nil, err
+	}
+	if resA.Currency == resB.Currency {
+		return nil, errors.New("Both accounts are in " + resA.Currency + ", use transfer_balance")
+	}
+
+	fx, err := t.retrieve_fx_rate(stub, resA.Currency, resB.Currency)
+	if err != nil {
+		return nil, err
+	}
+	now, err := t.get_tx_time(stub)
+	if err != nil {
+		return nil, err
+	}
+	if now - fx.Timestamp > FX_MAX_RATE_AGE {
+		return nil, errors.New(fmt.Sprintf("The %v/%v rate is stale, it was published %v seconds ago", fx.From, fx.To, now - fx.Timestamp))
+	}
+	rate, err := strconv.ParseFloat(fx.Rate, 64)
+	if err != nil {
+		return nil, errors.New("Corrupt " + fx.From + "/" + fx.To + " rate record")
+	}
+
+	err = t.transfer(stub, caller, resA, resB, amount, amount * rate, "fx transfer at " + fx.From + "/" + fx.To + " " + fx.Rate)
+	if err != nil {
+		return nil, err
+	}
+	err = t.collect_fee(stub, "transfer_fx", resA.AccountNo, amount)
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sreedhar310/learn-chaincode/identity"
+	"github.com/sreedhar310/learn-chaincode/validate"
+)
+
+// ============================================================================================================================
+// Account hierarchies - a legal entity can group its accounts under a parent account, any number of levels deep, and
+// see the group's balances rolled up by currency. A child can also be set to sweep into its parent: run_sweeps moves
+// whatever it holds above its threshold up to the parent, so cash is pooled where it is needed.
+// ============================================================================================================================
+var sweepIndexStr = "index:sweeps"
+
+type Currency_Total struct{
+	Currency string `json:"currency"`
+	Accounts int `json:"accounts"`
+	Balance string `json:"balance"`
+	Held string `json:"held"`
+	Available string `json:"available"`
+}
+
+type Consolidated_Balance struct{
+	AccountNo string `json:"accountno"`
+	Accounts []string `json:"accounts"`
+	Currencies []Currency_Total `json:"currencies"`
+}
+
+type Sweep_Result struct{
+	From string `json:"from"`
+	To string `json:"to"`
+	Amount string `json:"amount,omitempty"`
+	Swept bool `json:"swept"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func children_key(accountNo string) string {
+	return "children:" + accountNo
+}
+
+func remove_from_list(list []string, item string) []string {
+	var kept []string
+	for _, i := range list {
+		if i != item {
+			kept = append(kept, i)
+		}
+	}
+	return kept
+}
+
+// ============================================================================================================================
+// Set parent - put an account under a parent account, or take it out of its group with an empty parent. Both accounts
+// must belong to the caller, and an account can't end up beneath itself.
+// ============================================================================================================================
+func (t *SimpleChaincode) set_parent(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//       0            1
+	// "accountNo", "parentNo"
+
+	err := identity.CheckArgs(args, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	acc, err := t.retrieve_account(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if !is_owner(acc, caller) {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. set_parent. %v !== %v", caller, acc.LegalEntity))
+	}
+
+	if args[1] != "" {
+		parent, err := t.retrieve_account(stub, args[1])
+		if err != nil {
+			return nil, err
+		}
+		if parent.LegalEntity != acc.LegalEntity {
+			return nil, errors.New("A parent account must belong to the same legal entity")
+		}
+		if account_status(parent) == CLOSED || account_status(acc) == CLOSED {
+			return nil, errors.New("Closed accounts can't join a group")
+		}
+		if acc.SweepThreshold != "" && parent.Currency != acc.Currency {
+			return nil, errors.New("Account " + acc.AccountNo + " sweeps to its parent, which must be in " + acc.Currency)
+		}
+
+		// walk up from the new parent, the account mustn't be one of its ancestors
+		for ancestor := parent; ; {
+			if ancestor.AccountNo == acc.AccountNo {
+				return nil, errors.New("Account " + acc.AccountNo + " can't be put beneath itself")
+			}
+			if ancestor.Parent == "" {
+				break
+			}
+			ancestor, err = t.retrieve_account(stub, ancestor.Parent)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if acc.Parent != "" {
+		siblings, err := t.load_list(stub, children_key(acc.Parent))
+		if err != nil {
+			return nil, err
+		}
+		err = t.save_list(stub, children_key(acc.Parent), remove_from_list(siblings, acc.AccountNo))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if args[1] != "" {
+		children, err := t.load_list(stub, children_key(args[1]))
+		if err != nil {
+			return nil, err
+		}
+		err = t.save_list(stub, children_key(args[1]), append(children, acc.AccountNo))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	acc.Parent = args[1]
+	if acc.Parent == "" && acc.SweepThreshold != "" {
+		acc.SweepThreshold = ""
+		sweeping, err := t.load_list(stub, sweepIndexStr)
+		if err != nil {
+			return nil, err
+		}
+		err = t.save_list(stub, sweepIndexStr, remove_from_list(sweeping, acc.AccountNo))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, t.save_account(stub, acc)
+}
+
+// ============================================================================================================================
+// group_accounts - an account and everything beneath it, parents before their children
+// ============================================================================================================================
+func (t *SimpleChaincode) group_accounts(stub shim.ChaincodeStubInterface, root Account) ([]Account, error) {
+	group := []Account{root}
+	seen := map[string]bool{root.AccountNo: true}
+
+	for i := 0; i < len(group); i++ {
+		children, err := t.load_list(stub, children_key(group[i].AccountNo))
+		if err != nil {
+			return nil, err
+		}
+		for _, accountNo := range children {
+			if seen[accountNo] {
+				continue
+			}
+			seen[accountNo] = true
+			child, err := t.retrieve_account(stub, accountNo)
+			if err != nil {
+				return nil, err
+			}
+			group = append(group, child)
+		}
+	}
+	return group, nil
+}
+
+// ============================================================================================================================
+// Get consolidated balance - the balances, holds and available funds of an account and everything beneath it, totalled
+// by currency. Visible to the owner and the top account's delegates.
+// ============================================================================================================================
+func (t *SimpleChaincode) get_consolidated_balance(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//       0
+	// "accountNo"
+
+	err := identity.CheckArgs(args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := t.retrieve_account(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if !is_owner(root, caller) && find_delegate(root, caller) < 0 {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. get_consolidated_balance. %v !== %v", caller, root.LegalEntity))
+	}
+
+	group, err := t.group_accounts(stub, root)
+	if err != nil {
+		return nil, err
+	}
+
+	result := Consolidated_Balance{AccountNo: root.AccountNo}
+	totals := map[string]*Currency_Total{}
+	sums := map[string][]float64{}
+	for _, acc := range group {
+		balance, err := strconv.ParseFloat(acc.Balance, 64)
+		if err != nil {
+			return nil, errors.New("Corrupt balance on account " + acc.AccountNo)
+		}
+		held, err := parse_optional(acc.Held)
+		if err != nil {
+			return nil, errors.New("Corrupt held amount on account " + acc.AccountNo)
+		}
+		available, err := available_funds(acc)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := totals[acc.Currency]; !ok {
+			totals[acc.Currency] = &Currency_Total{Currency: acc.Currency}
+			sums[acc.Currency] = make([]float64, 3)
+		}
+		totals[acc.Currency].Accounts++
+		sums[acc.Currency][0] += balance
+		sums[acc.Currency][1] += held
+		sums[acc.Currency][2] += available
+		result.Accounts = append(result.Accounts, acc.AccountNo)
+	}
+
+	var currencies []string
+	for currency := range totals {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	for _, currency := range currencies {
+		total := totals[currency]
+		total.Balance = strconv.FormatFloat(sums[currency][0], 'E', -1, 64)
+		total.Held = strconv.FormatFloat(sums[currency][1], 'E', -1, 64)
+		total.Available = strconv.FormatFloat(sums[currency][2], 'E', -1, 64)
+		result.Currencies = append(result.Currencies, *total)
+	}
+
+	return json.Marshal(result)
+}
+
+// ============================================================================================================================
+// Set sweep - sweep whatever an account holds above a threshold up to its parent, or stop sweeping with an empty
+// threshold. The parent must be in the same currency. Owner only.
+// ============================================================================================================================
+func (t *SimpleChaincode) set_sweep(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//       0          1
+	// "accountNo", "5000"
+
+	err := identity.CheckArgs(args, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	acc, err := t.retrieve_account(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if !is_owner(acc, caller) {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. set_sweep. %v !== %v", caller, acc.LegalEntity))
+	}
+
+	sweeping, err := t.load_list(stub, sweepIndexStr)
+	if err != nil {
+		return nil, err
+	}
+	sweeping = remove_from_list(sweeping, acc.AccountNo)
+
+	if args[1] == "" {
+		acc.SweepThreshold = ""
+	} else {
+		if acc.Parent == "" {
+			return nil, errors.New("Account " + acc.AccountNo + " has no parent to sweep to")
+		}
+		parent, err := t.retrieve_account(stub, acc.Parent)
+		if err != nil {
+			return nil, err
+		}
+		if parent.Currency != acc.Currency {
+			return nil, errors.New(fmt.Sprintf("Can't sweep %v in %v to its parent in %v", acc.AccountNo, acc.Currency, parent.Currency))
+		}
+		threshold, err := validate.Balance(args[1])
+		if err != nil {
+			return nil, errors.New("Invalid threshold: " + err.Error())
+		}
+		acc.SweepThreshold = strconv.FormatFloat(threshold, 'E', -1, 64)
+		sweeping = append(sweeping, acc.AccountNo)
+	}
+
+	err = t.save_list(stub, sweepIndexStr, sweeping)
+	if err != nil {
+		return nil, err
+	}
+	return nil, t.save_account(stub, acc)
+}
+
+// ============================================================================================================================
+// sweep - move what an account holds above its threshold to its parent, returning why not if it can't
+// ============================================================================================================================
+func (t *SimpleChaincode) sweep(stub shim.ChaincodeStubInterface, acc Account, result *Sweep_Result) (string, error) {
+	parent, err := t.retrieve_account(stub, acc.Parent)
+	if err != nil {
+		return "", err
+	}
+	if check_debit(acc) != nil {
+		return "account is " + account_status(acc), nil
+	}
+	if check_credit(parent) != nil {
+		return "parent doesn't accept credits", nil
+	}
+
+	threshold, err := parse_optional(acc.SweepThreshold)
+	if err != nil {
+		return "", errors.New("Corrupt sweep threshold on account " + acc.AccountNo)
+	}
+	balance, err := strconv.ParseFloat(acc.Balance, 64)
+	if err != nil {
+		return "", errors.New("Corrupt balance on account " + acc.AccountNo)
+	}
+	held, err := parse_optional(acc.Held)
+	if err != nil {
+		return "", errors.New("Corrupt held amount on account " + acc.AccountNo)
+	}
+
+	// funds on hold stay behind, they are already promised to someone
+	amount := balance - held - threshold
+	if amount <= 0 {
+		return "nothing above the threshold", nil
+	}
+
+	result.Amount = strconv.FormatFloat(amount, 'E', -1, 64)
+	return "", t.move(stub, acc, parent, amount, amount, "cash pooling sweep")
+}
+
+// ============================================================================================================================
+// account_depth - how many parents an account has above it
+// ============================================================================================================================
+func (t *SimpleChaincode) account_depth(stub shim.ChaincodeStubInterface, acc Account) (int, error) {
+	depth := 0
+	for acc.Parent != "" {
+		parent, err := t.retrieve_account(stub, acc.Parent)
+		if err != nil {
+			return 0, err
+		}
+		acc = parent
+		depth++
+	}
+	return depth, nil
+}
+
+// ============================================================================================================================
+// Run sweeps - sweep every sweeping account, or just those directly beneath one parent. Called by the external
+// scheduler, anyone may call it. Children are swept before their parents, so a sweep reaches the top in one run.
+// ============================================================================================================================
+func (t *SimpleChaincode) run_sweeps(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//        0
+	// ["parentNo"]
+
+	var err error
+	if len(args) != 1 {
+		err = identity.CheckArgs(args, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sweeping, err := t.load_list(stub, sweepIndexStr)
+	if err != nil {
+		return nil, err
+	}
+
+	// order the accounts deepest first
+	var levels [][]Account
+	for _, accountNo := range sweeping {
+		acc, err := t.retrieve_account(stub, accountNo)
+		if err != nil {
+			return nil, err
+		}
+		if len(args) == 1 && acc.Parent != args[0] {
+			continue
+		}
+		depth, err := t.account_depth(stub, acc)
+		if err != nil {
+			return nil, err
+		}
+		for len(levels) <= depth {
+			levels = append(levels, nil)
+		}
+		levels[depth] = append(levels[depth], acc)
+	}
+	var accounts []Account
+	for depth := len(levels) - 1; depth >= 0; depth-- {
+		accounts = append(accounts, levels[depth]...)
+	}
+
+	results := []Sweep_Result{}
+	for _, acc := range accounts {
+		// an earlier sweep in this run may have credited this account
+		acc, err = t.retrieve_account(stub, acc.AccountNo)
+		if err != nil {
+			return nil, err
+		}
+
+		result := Sweep_Result{From: acc.AccountNo, To: acc.Parent}
+		reason, err := t.sweep(stub, acc, &result)
+		if err != nil {
+			return nil, err
+		}
+		result.Swept = reason == ""
+		result.Reason = reason
+		results = append(results, result)
+	}
+
+	return json.Marshal(results)
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sreedhar310/learn-chaincode/identity"
+	"github.com/sreedhar310/learn-chaincode/validate"
+)
+
+// ============================================================================================================================
+// Holds - funds reserved on an account for a payee before the final amount is known. A hold lowers the available funds
+// of the account but not its balance. The payee captures all or part of it, as often as needed, up to the amount held,
+// and releases whatever it won't capture. Holds the payee leaves open are released by expire_holds once they expire.
+// ============================================================================================================================
+const HOLD_OPEN = "OPEN"
+const HOLD_CAPTURED = "CAPTURED"
+const HOLD_RELEASED = "RELEASED"
+const HOLD_EXPIRED = "EXPIRED"
+
+var holdIndexStr = "index:holds"				// the IDs of every open hold, for expire_holds
+
+type Hold struct{
+	HoldId string `json:"holdid"`
+	AccountNo string `json:"accountno"`
+	Payee string `json:"payee"`
+	Amount string `json:"amount"`
+	Captured string `json:"captured"`
+	Status string `json:"status"`
+	Expiry int64 `json:"expiry"`
+	PlacedBy string `json:"placedby"`
+}
+
+func hold_key(holdId string) string {
+	return "hold:" + holdId
+}
+
+func account_holds_key(accountNo string) string {
+	return "holds:" + accountNo
+}
+
+func (t *SimpleChaincode) retrieve_hold(stub shim.ChaincodeStubInterface, holdId string) (Hold, error) {
+	var hold Hold
+
+	holdAsBytes, err := stub.GetState(hold_key(holdId))
+	if err != nil {
+		return hold, errors.New("Failed to get hold " + holdId)
+	}
+	if holdAsBytes == nil {
+		return hold, errors.New("Hold " + holdId + " does not exist")
+	}
+	err = json.Unmarshal(holdAsBytes, &hold)
+	if err != nil {
+		return hold, errors.New("Corrupt hold record " + holdId)
+	}
+	return hold, nil
+}
+
+func (t *SimpleChaincode) save_hold(stub shim.ChaincodeStubInterface, hold Hold) error {
+	holdAsBytes, _ := json.Marshal(hold)
+	return stub.PutState(hold_key(hold.HoldId), holdAsBytes)
+}
+
+// load_list / save_list - read and write a JSON list of IDs, such as the hold indexes
+func (t *SimpleChaincode) load_list(stub shim.ChaincodeStubInterface, key string) ([]string, error) {
+	var list []string
+
+	listAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, errors.New("Failed to get " + key)
+	}
+	if listAsBytes == nil {
+		return list, nil
+	}
+	err = json.Unmarshal(listAsBytes, &list)
+	if err != nil {
+		return nil, errors.New("Corrupt list " + key)
+	}
+	return list, nil
+}
+
+func (t *SimpleChaincode) save_list(stub shim.ChaincodeStubInterface, key string, list []string) error {
+	listAsBytes, _ := json.Marshal(list)
+	return stub.PutState(key, listAsBytes)
+}
+
+// ============================================================================================================================
+// adjust_held - add to, or with a negative delta take from, the amount held on an account
+// ============================================================================================================================
+func adjust_held(acc *Account, delta float64) error {
+	held, err := parse_optional(acc.Held)
+	if err != nil {
+		return errors.New("Corrupt held amount on account " + acc.AccountNo)
+	}
+	held = held + delta
+	if held < 0 {
+		held = 0
+	}
+	acc.Held = strconv.FormatFloat(held, 'E', -1, 64)
+	return nil
+}
+
+// ============================================================================================================================
+// end_hold - release what is left of a hold, giving it back to the limit of the delegate who placed it, and take the
+// hold out of the open hold index
+// ============================================================================================================================
+func (t *SimpleChaincode) end_hold(stub shim.ChaincodeStubInterface, hold Hold, status string) error {
+	amount, _ := strconv.ParseFloat(hold.Amount, 64)
+	captured, _ := strconv.ParseFloat(hold.Captured, 64)
+
+	acc, err := t.retrieve_account(stub, hold.AccountNo)
+	if err != nil {
+		return err
+	}
+	err = adjust_held(&acc, -(amount - captured))
+	if err != nil {
+		return err
+	}
+	err = refund_delegate(&acc, hold.PlacedBy, amount - captured)
+	if err != nil {
+		return err
+	}
+	err = t.save_account(stub, acc)
+	if err != nil {
+		return err
+	}
+
+	hold.Status = status
+	err = t.save_hold(stub, hold)
+	if err != nil {
+		return err
+	}
+
+	open, err := t.load_list(stub, holdIndexStr)
+	if err != nil {
+		return err
+	}
+	for i, id := range open {
+		if id == hold.HoldId {
+			open = append(open[:i], open[i+1:]...)
+			break
+		}
+	}
+	return t.save_list(stub, holdIndexStr, open)
+}
+
+// ============================================================================================================================
+// Place hold - reserve funds on an account for a payee for a number of seconds. Made by the owner or a delegate, and
+// returns the hold ID.
+// ============================================================================================================================
+func (t *SimpleChaincode) place_hold(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//       0            1          2        3
+	// "accountNo", "payeeNo", "250.00", "86400"
+
+	err := identity.CheckArgs(args, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	amount, err := validate.Money(args[2])
+	if err != nil {
+		return nil, errors.New("3rd argument must be a positive amount with at most two decimal places")
+	}
+	duration, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil || duration <= 0 {
+		return nil, errors.New("4th argument must be a positive number of seconds")
+	}
+	if args[0] == args[1] {
+		return nil, errors.New("Can't hold funds for the same account")
+	}
+
+	acc, err := t.retrieve_account(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	payee, err := t.retrieve_account(stub, args[1])
+	if err != nil {
+		return nil, err
+	}
+	if acc.Currency != payee.Currency {
+		return nil, errors.New(fmt.Sprintf("Currency mismatch. %v is in %v and %v is in %v", acc.AccountNo, acc.Currency, payee.AccountNo, payee.Currency))
+	}
+	err = check_debit(acc)
+	if err != nil {
+		return nil, err
+	}
+	err = check_credit(payee)
+	if err != nil {
+		return nil, err
+	}
+	err = authorize_debit(&acc, caller, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	available, err := available_funds(acc)
+	if err != nil {
+		return nil, err
+	}
+	if amount > available {
+		return nil, errors.New(acc.AccountNo + " doesn't have enough available funds to place the hold")
+	}
+
+	now, err := t.get_tx_time(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	hold := Hold{
+		HoldId: stub.GetTxID(),
+		AccountNo: acc.AccountNo,
+		Payee: payee.AccountNo,
+		Amount: strconv.FormatFloat(amount, 'E', -1, 64),
+		Captured: strconv.FormatFloat(0, 'E', -1, 64),
+		Status: HOLD_OPEN,
+		Expiry: now + duration,
+		PlacedBy: caller,
+	}
+	err = t.save_hold(stub, hold)
+	if err != nil {
+		return nil, err
+	}
+
+	err = adjust_held(&acc, amount)
+	if err != nil {
+		return nil, err
+	}
+	err = t.save_account(stub, acc)
+	if err != nil {
+		return nil, err
+	}
+
+	holds, err := t.load_list(stub, account_holds_key(acc.AccountNo))
+	if err != nil {
+		return nil, err
+	}
+	err = t.save_list(stub, account_holds_key(acc.AccountNo), append(holds, hold.HoldId))
+	if err != nil {
+		return nil, err
+	}
+
+	open, err := t.load_list(stub, holdIndexStr)
+	if err != nil {
+		return nil, err
+	}
+	err = t.save_list(stub, holdIndexStr, append(open, hold.HoldId))
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(hold.HoldId), nil
+}
+
+// ============================================================================================================================
+// Capture hold - the payee's owner takes some or all of what is still held into the payee account. The hold closes
+// once it has been captured in full.
+// ============================================================================================================================
+func (t *SimpleChaincode) capture_hold(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//     0          1
+	// "holdId", "120.00"
+
+	err := identity.CheckArgs(args, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	hold, err := t.retrieve_hold(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if hold.Status != HOLD_OPEN {
+		return nil, errors.New("Hold " + hold.HoldId + " is " + hold.Status)
+	}
+
+	payee, err := t.retrieve_account(stub, hold.Payee)
+	if err != nil {
+		return nil, err
+	}
+	if !is_owner(payee, caller) {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. capture_hold. %v !== %v", caller, payee.LegalEntity))
+	}
+
+	now, err := t.get_tx_time(stub)
+	if err != nil {
+		return nil, err
+	}
+	if now >= hold.Expiry {
+		return nil, errors.New("Hold " + hold.HoldId + " has expired")
+	}
+
+	amount, err := validate.Money(args[1])
+	if err != nil {
+		return nil, errors.New("2nd argument must be a positive amount with at most two decimal places")
+	}
+	held, _ := strconv.ParseFloat(hold.Amount, 64)
+	captured, _ := strconv.ParseFloat(hold.Captured, 64)
+	if captured + amount > held {
+		return nil, errors.New(fmt.Sprintf("Only %v is left on hold %v", held - captured, hold.HoldId))
+	}
+
+	// take the capture off the hold first so the funds it reserved are available to the move
+	acc, err := t.retrieve_account(stub, hold.AccountNo)
+	if err != nil {
+		return nil, err
+	}
+	err = adjust_held(&acc, -amount)
+	if err != nil {
+		return nil, err
+	}
+	err = t.move(stub, acc, payee, amount, amount, "hold " + hold.HoldId + " captured")
+	if err != nil {
+		return nil, err
+	}
+
+	hold.Captured = strconv.FormatFloat(captured + amount, 'E', -1, 64)
+	if captured + amount < held {
+		return nil, t.save_hold(stub, hold)
+	}
+	return nil, t.end_hold(stub, hold, HOLD_CAPTURED)
+}
+
+// ============================================================================================================================
+// Release hold - the payee's owner gives up what is left of a hold
+// ============================================================================================================================
+func (t *SimpleChaincode) release_hold(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//     0
+	// "holdId"
+
+	err := identity.CheckArgs(args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	hold, err := t.retrieve_hold(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if hold.Status != HOLD_OPEN {
+		return nil, errors.New("Hold " + hold.HoldId + " is " + hold.Status)
+	}
+
+	payee, err := t.retrieve_account(stub, hold.Payee)
+	if err != nil {
+		return nil, err
+	}
+	if !is_owner(payee, caller) {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. release_hold. %v !== %v", caller, payee.LegalEntity))
+	}
+
+	return nil, t.end_hold(stub, hold, HOLD_RELEASED)
+}
+
+// ============================================================================================================================
+// Expire holds - release every open hold past its expiry. Anyone may call it, the transaction timestamp decides.
+// ============================================================================================================================
+func (t *SimpleChaincode) expire_holds(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	err := identity.CheckArgs(args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := t.get_tx_time(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	open, err := t.load_list(stub, holdIndexStr)
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []string
+	for _, id := range open {
+		hold, err := t.retrieve_hold(stub, id)
+		if err != nil {
+			return nil, err
+		}
+		if now >= hold.Expiry {
+			err = t.end_hold(stub, hold, HOLD_EXPIRED)
+			if err != nil {
+				return nil, err
+			}
+			expired = append(expired, id)
+		}
+	}
+
+	if expired == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(expired)
+}
+
+// ============================================================================================================================
+// Get holds - every hold ever placed on an account. Visible to the owner and delegates.
+// ============================================================================================================================
+func (t *SimpleChaincode) get_holds(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//       0
+	// "accountNo"
+
+	err := identity.CheckArgs(args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	acc, err := t.retrieve_account(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if !is_owner(acc, caller) && find_delegate(acc, caller) < 0 {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. get_holds. %v !== %v", caller, acc.LegalEntity))
+	}
+
+	ids, err := t.load_list(stub, account_holds_key(acc.AccountNo))
+	if err != nil {
+		return nil, err
+	}
+
+	holds := []Hold{}
+	for _, id := range ids {
+		hold, err := t.retrieve_hold(stub, id)
+		if err != nil {
+			return nil, err
+		}
+		holds = append(holds, hold)
+	}
+	return json.Marshal(holds)
+}
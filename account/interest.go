@@ -0,0 +1,431 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sreedhar310/learn-chaincode/identity"
+	"github.com/sreedhar310/learn-chaincode/ledger"
+	"github.com/sreedhar310/learn-chaincode/validate"
+)
+
+// ============================================================================================================================
+// Deposit interest - a credit balance earns interest at the rate of the account's interest product, or at a rate set
+// on the account itself, counted with the product's or the account's day count convention. accrue_interest accrues it
+// for the whole days since the last accrual, posting each accrual to the general ledger as an expense owed to the
+// customer, and credits what has accrued to the balance on the first run in each new month. Like overdraft interest,
+// it is also accrued up to the transaction time before every change to the balance, so each balance earns for exactly
+// as long as it was held, however often accrue_interest runs.
+// ============================================================================================================================
+const ACT_365 = "ACT/365"
+const ACT_360 = "ACT/360"
+const THIRTY_360 = "30/360"
+
+var day_counts = []string{ACT_365, ACT_360, THIRTY_360}
+
+type Interest_Product struct{
+	Name string `json:"name"`
+	Rate string `json:"rate"`
+	DayCount string `json:"daycount"`
+}
+
+type Accrued_Interest struct{
+	AccountNo string `json:"accountno"`
+	Product string `json:"product,omitempty"`
+	Rate string `json:"rate"`
+	DayCount string `json:"daycount"`
+	Accrued string `json:"accrued"`
+	AccruedTo string `json:"accruedto"`
+	LastPosted string `json:"lastposted"`
+}
+
+type Accrual_Result struct{
+	AccountNo string `json:"accountno"`
+	Accrued string `json:"accrued"`
+	Posted string `json:"posted,omitempty"`
+}
+
+func product_key(name string) string {
+	return "product:" + name
+}
+
+func valid_day_count(dayCount string) bool {
+	for _, d := range day_counts {
+		if d == dayCount {
+			return true
+		}
+	}
+	return false
+}
+
+// ============================================================================================================================
+// year_fraction - the part of a year between two times under a day count convention. 30/360 counts every month as 30
+// days, treating the 31st as the 30th when the period starts on the 30th or 31st.
+// ============================================================================================================================
+func year_fraction(dayCount string, from int64, to int64) float64 {
+	if dayCount == THIRTY_360 {
+		start := time.Unix(from, 0).UTC()
+		end := time.Unix(to, 0).UTC()
+		d1, d2 := start.Day(), end.Day()
+		if d1 == 31 {
+			d1 = 30
+		}
+		if d2 == 31 && d1 == 30 {
+			d2 = 30
+		}
+		days := 360 * (end.Year() - start.Year()) + 30 * (int(end.Month()) - int(start.Month())) + d2 - d1
+		return float64(days) / 360
+	}
+
+	days := float64(to - from) / SECONDS_PER_DAY
+	if dayCount == ACT_360 {
+		return days / 360
+	}
+	return days / DAYS_PER_YEAR
+}
+
+func (t *SimpleChaincode) retrieve_product(stub shim.ChaincodeStubInterface, name string) (Interest_Product, error) {
+	var product Interest_Product
+
+	productAsBytes, err := stub.GetState(product_key(name))
+	if err != nil {
+		return product, errors.New("Failed to get interest product " + name)
+	}
+	if productAsBytes == nil {
+		return product, errors.New("No such interest product: " + name)
+	}
+	err = json.Unmarshal(productAsBytes, &product)
+	if err != nil {
+		return product, errors.New("Corrupt interest product " + name)
+	}
+	return product, nil
+}
+
+// ============================================================================================================================
+// interest_terms - the rate and day count an account earns at, its own where set and its product's otherwise
+// ============================================================================================================================
+func (t *SimpleChaincode) interest_terms(stub shim.ChaincodeStubInterface, acc Account) (float64, string, error) {
+	rate := acc.DepositRate
+	dayCount := acc.DayCount
+
+	if acc.InterestProduct != "" {
+		product, err := t.retrieve_product(stub, acc.InterestProduct)
+		if err != nil {
+			return 0, "", err
+		}
+		if rate == "" {
+			rate = product.Rate
+		}
+		if dayCount == "" {
+			dayCount = product.DayCount
+		}
+	}
+	if dayCount == "" {
+		dayCount = ACT_365
+	}
+
+	r, err := parse_optional(rate)
+	if err != nil {
+		return 0, "", errors.New("Corrupt deposit rate on account " + acc.AccountNo)
+	}
+	return r, dayCount, nil
+}
+
+// ============================================================================================================================
+// accrue_deposit_interest - accrue interest on the balance for the time since the last accrual
+// ============================================================================================================================
+func (t *SimpleChaincode) accrue_deposit_interest(stub shim.ChaincodeStubInterface, acc Account, now int64) (Account, float64, error) {
+	if acc.AccruedTo == 0 || now <= acc.AccruedTo {
+		return acc, 0, nil
+	}
+	from := acc.AccruedTo
+	acc.AccruedTo = now
+
+	rate, dayCount, err := t.interest_terms(stub, acc)
+	if err != nil {
+		return acc, 0, err
+	}
+	balance, err := strconv.ParseFloat(acc.Balance, 64)
+	if err != nil {
+		return acc, 0, errors.New("Corrupt balance on account " + acc.AccountNo)
+	}
+
+	interest := balance * rate * year_fraction(dayCount, from, acc.AccruedTo)
+	if interest <= 0 {
+		return acc, 0, nil
+	}
+
+	accrued, err := parse_optional(acc.InterestAccrued)
+	if err != nil {
+		return acc, 0, errors.New("Corrupt accrued interest on account " + acc.AccountNo)
+	}
+	acc.InterestAccrued = strconv.FormatFloat(accrued + interest, 'E', -1, 64)
+
+	return acc, interest, ledger.Post(stub, "interest accrued " + acc.AccountNo,
+		ledger.Debit(ledger.InterestExpense, acc.Currency, interest),
+		ledger.Credit(ledger.InterestPayable, acc.Currency, interest))
+}
+
+// ============================================================================================================================
+// post_deposit_interest - credit the accrued interest to the balance, once a month. An account that can't be credited
+// just now keeps its interest accrued until it can.
+// ============================================================================================================================
+func (t *SimpleChaincode) post_deposit_interest(stub shim.ChaincodeStubInterface, acc Account, now int64) (Account, float64, error) {
+	last := time.Unix(acc.InterestPosted, 0).UTC()
+	current := time.Unix(now, 0).UTC()
+	if last.Year() == current.Year() && last.Month() == current.Month() {
+		return acc, 0, nil
+	}
+
+	accrued, err := parse_optional(acc.InterestAccrued)
+	if err != nil {
+		return acc, 0, errors.New("Corrupt accrued interest on account " + acc.AccountNo)
+	}
+	if accrued <= 0 {
+		acc.InterestPosted = now
+		return acc, 0, nil
+	}
+	if check_credit(acc) != nil {
+		return acc, 0, nil
+	}
+
+	balance, err := strconv.ParseFloat(acc.Balance, 64)
+	if err != nil {
+		return acc, 0, errors.New("Corrupt balance on account " + acc.AccountNo)
+	}
+	balance = balance + accrued
+	acc.Balance = strconv.FormatFloat(balance, 'E', -1, 64)
+	acc.InterestAccrued = ""
+	acc.InterestPosted = now
+
+	err = t.journal(stub, acc.AccountNo, "", accrued, balance, "deposit interest")
+	if err != nil {
+		return acc, 0, err
+	}
+	err = t.adjust_supply(stub, acc.Currency, accrued)
+	if err != nil {
+		return acc, 0, err
+	}
+	return acc, accrued, ledger.Post(stub, "deposit interest " + acc.AccountNo,
+		ledger.Debit(ledger.InterestPayable, acc.Currency, accrued),
+		ledger.Credit(ledger.Customer(acc.AccountNo), acc.Currency, accrued))
+}
+
+// ============================================================================================================================
+// Set interest product - create or change an interest product. Credit officers only. A new rate applies from each
+// account's last accrual, so run accrue_interest before changing one.
+// ============================================================================================================================
+func (t *SimpleChaincode) set_interest_product(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//       0          1        2
+	// "saver", "0.025", "ACT/365"
+
+	err := identity.CheckArgs(args, 3)
+	if err != nil {
+		return nil, err
+	}
+	err = t.check_role(stub, caller, CREDIT_OFFICER, "set_interest_product")
+	if err != nil {
+		return nil, err
+	}
+	if err = validate.Name(args[0]); err != nil {
+		return nil, errors.New("Invalid product name: " + err.Error())
+	}
+	rate, err := validate.Rate(args[1])
+	if err != nil {
+		return nil, errors.New("Invalid deposit rate: " + err.Error())
+	}
+	if !valid_day_count(args[2]) {
+		return nil, errors.New(fmt.Sprintf("Day count must be one of %v", day_counts))
+	}
+
+	product := Interest_Product{Name: args[0], Rate: strconv.FormatFloat(rate, 'E', -1, 64), DayCount: args[2]}
+	productAsBytes, err := json.Marshal(product)
+	if err != nil {
+		return nil, errors.New("Error converting interest product")
+	}
+	return nil, stub.PutState(product_key(product.Name), productAsBytes)
+}
+
+// ============================================================================================================================
+// Set account interest - put an account on an interest product, or give it its own rate or day count. Empty values
+// are taken from the product. Interest to date is accrued on the old terms first. Credit officers only.
+// ============================================================================================================================
+func (t *SimpleChaincode) set_account_interest(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//       0          1        2         3
+	// "accountNo", "saver", "0.03", "ACT/360"
+
+	err := identity.CheckArgs(args, 4)
+	if err != nil {
+		return nil, err
+	}
+	err = t.check_role(stub, caller, CREDIT_OFFICER, "set_account_interest")
+	if err != nil {
+		return nil, err
+	}
+
+	acc, err := t.retrieve_account(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if account_status(acc) == CLOSED {
+		return nil, errors.New("Account " + acc.AccountNo + " is closed")
+	}
+	if args[1] != "" {
+		if _, err = t.retrieve_product(stub, args[1]); err != nil {
+			return nil, err
+		}
+	}
+	if args[2] != "" {
+		rate, err := validate.Rate(args[2])
+		if err != nil {
+			return nil, errors.New("Invalid deposit rate: " + err.Error())
+		}
+		args[2] = strconv.FormatFloat(rate, 'E', -1, 64)
+	}
+	if args[3] != "" && !valid_day_count(args[3]) {
+		return nil, errors.New(fmt.Sprintf("Day count must be one of %v", day_counts))
+	}
+
+	now, err := t.get_tx_time(stub)
+	if err != nil {
+		return nil, err
+	}
+	if acc.AccruedTo != 0 {
+		acc, _, err = t.accrue_deposit_interest(stub, acc, now)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		acc.AccruedTo = now
+		acc.InterestPosted = now
+	}
+
+	acc.InterestProduct = args[1]
+	acc.DepositRate = args[2]
+	acc.DayCount = args[3]
+	return nil, t.save_account(stub, acc)
+}
+
+// ============================================================================================================================
+// Accrue interest - accrue deposit interest up to the transaction timestamp, for one account or for every account
+// earning interest, and post it at the start of each month. Called by the external scheduler, anyone may call it.
+// ============================================================================================================================
+func (t *SimpleChaincode) accrue_interest(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//        0
+	// ["accountNo"]
+
+	var err error
+	if len(args) != 1 {
+		err = identity.CheckArgs(args, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	now, err := t.get_tx_time(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var accountNos []string
+	if len(args) == 1 {
+		accountNos = append(accountNos, args[0])
+	} else {
+		index, err := t.retrieve_account_index(stub)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range index {
+			if entry.Status != CLOSED {
+				accountNos = append(accountNos, entry.AccountNo)
+			}
+		}
+	}
+
+	results := []Accrual_Result{}
+	for _, accountNo := range accountNos {
+		acc, err := t.retrieve_account(stub, accountNo)
+		if err != nil {
+			return nil, err
+		}
+		if acc.AccruedTo == 0 || account_status(acc) == CLOSED {
+			if len(args) == 1 {
+				return nil, errors.New("Account " + acc.AccountNo + " doesn't earn interest")
+			}
+			continue
+		}
+
+		acc, accrued, err := t.accrue_deposit_interest(stub, acc, now)
+		if err != nil {
+			return nil, err
+		}
+		acc, posted, err := t.post_deposit_interest(stub, acc, now)
+		if err != nil {
+			return nil, err
+		}
+		err = t.save_account(stub, acc)
+		if err != nil {
+			return nil, err
+		}
+
+		result := Accrual_Result{AccountNo: acc.AccountNo, Accrued: strconv.FormatFloat(accrued, 'E', -1, 64)}
+		if posted > 0 {
+			result.Posted = strconv.FormatFloat(posted, 'E', -1, 64)
+		}
+		results = append(results, result)
+	}
+
+	return json.Marshal(results)
+}
+
+// ============================================================================================================================
+// Get accrued interest - the interest accrued but not yet posted to the balance, and the terms it accrues on. Visible
+// to the owner and delegates.
+// ============================================================================================================================
+func (t *SimpleChaincode) get_accrued_interest(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//       0
+	// "accountNo"
+
+	err := identity.CheckArgs(args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	acc, err := t.retrieve_account(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if !is_owner(acc, caller) && find_delegate(acc, caller) < 0 {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. get_accrued_interest. %v !== %v", caller, acc.LegalEntity))
+	}
+	if acc.AccruedTo == 0 {
+		return nil, errors.New("Account " + acc.AccountNo + " doesn't earn interest")
+	}
+
+	rate, dayCount, err := t.interest_terms(stub, acc)
+	if err != nil {
+		return nil, err
+	}
+	accrued, err := parse_optional(acc.InterestAccrued)
+	if err != nil {
+		return nil, errors.New("Corrupt accrued interest on account " + acc.AccountNo)
+	}
+
+	return json.Marshal(Accrued_Interest{
+		AccountNo: acc.AccountNo,
+		Product: acc.InterestProduct,
+		Rate: strconv.FormatFloat(rate, 'E', -1, 64),
+		DayCount: dayCount,
+		Accrued: strconv.FormatFloat(accrued, 'E', -1, 64),
+		AccruedTo: time.Unix(acc.AccruedTo, 0).UTC().Format(STATEMENT_DATE),
+		LastPosted: time.Unix(acc.InterestPosted, 0).UTC().Format(STATEMENT_DATE),
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sreedhar310/learn-chaincode/identity"
+)
+
+// ============================================================================================================================
+// Journal Entry - one movement on an account. Amount is positive for a credit and negative for a debit, and Balance
+// is the account balance once the entry was applied. Counterparty is the other account, empty when there isn't one.
+// ============================================================================================================================
+type Journal_Entry struct{
+	TxId string `json:"txid"`
+	Timestamp int64 `json:"timestamp"`
+	Counterparty string `json:"counterparty"`
+	Amount string `json:"amount"`
+	Balance string `json:"balance"`
+	Memo string `json:"memo"`
+}
+
+// ============================================================================================================================
+// Statement - the journal entries of an account between two dates, with the balances either side of them
+// ============================================================================================================================
+type Statement struct{
+	AccountNo string `json:"accountno"`
+	Currency string `json:"currency"`
+	From string `json:"from"`
+	To string `json:"to"`
+	OpeningBalance string `json:"openingbalance"`
+	ClosingBalance string `json:"closingbalance"`
+	Entries []Journal_Entry `json:"entries"`
+}
+
+const STATEMENT_DATE = "2006-01-02"
+
+func journal_key(accountNo string) string {
+	return "journal:" + accountNo
+}
+
+func (t *SimpleChaincode) retrieve_journal(stub shim.ChaincodeStubInterface, accountNo string) ([]Journal_Entry, error) {
+	var entries []Journal_Entry
+
+	journalAsBytes, err := stub.GetState(journal_key(accountNo))
+	if err != nil {
+		return nil, errors.New("Failed to get the journal for " + accountNo)
+	}
+	if journalAsBytes == nil {
+		return entries, nil
+	}
+	err = json.Unmarshal(journalAsBytes, &entries)
+	if err != nil {
+		return nil, errors.New("Corrupt journal for " + accountNo)
+	}
+	return entries, nil
+}
+
+// ============================================================================================================================
+// journal - append an entry to an account's journal. Called for every change to an account balance.
+// ============================================================================================================================
+func (t *SimpleChaincode) journal(stub shim.ChaincodeStubInterface, accountNo string, counterparty string, amount float64, balance float64, memo string) error {
+	entries, err := t.retrieve_journal(stub, accountNo)
+	if err != nil {
+		return err
+	}
+
+	now, err := t.get_tx_time(stub)
+	if err != nil {
+		return err
+	}
+
+	entries = append(entries, Journal_Entry{
+		TxId: stub.GetTxID(),
+		Timestamp: now,
+		Counterparty: counterparty,
+		Amount: strconv.FormatFloat(amount, 'E', -1, 64),
+		Balance: strconv.FormatFloat(balance, 'E', -1, 64),
+		Memo: memo,
+	})
+
+	journalAsBytes, _ := json.Marshal(entries)
+	return stub.PutState(journal_key(accountNo), journalAsBytes)
+}
+
+// ============================================================================================================================
+// Get statement - the journal entries of an account between two dates, both inclusive and in UTC. Visible to the owner
+// and the account's delegates.
+// ============================================================================================================================
+func (t *SimpleChaincode) get_statement(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//       0              1              2
+	// "accountNo", "2017-01-01", "2017-01-31"
+
+	err := identity.CheckArgs(args, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	acc, err := t.retrieve_account(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if !is_owner(acc, caller) && find_delegate(acc, caller) < 0 {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. get_statement. %v !== %v", caller, acc.LegalEntity))
+	}
+
+	from, err := time.Parse(STATEMENT_DATE, args[1])
+	if err != nil {
+		return nil, errors.New("Invalid from date, expecting " + STATEMENT_DATE)
+	}
+	to, err := time.Parse(STATEMENT_DATE, args[2])
+	if err != nil {
+		return nil, errors.New("Invalid to date, expecting " + STATEMENT_DATE)
+	}
+	if to.Before(from) {
+		return nil, errors.New("The to date is before the from date")
+	}
+	start := from.Unix()
+	end := to.AddDate(0, 0, 1).Unix()
+
+	entries, err := t.retrieve_journal(stub, acc.AccountNo)
+	if err != nil {
+		return nil, err
+	}
+
+	zero := strconv.FormatFloat(0, 'E', -1, 64)
+	statement := Statement{AccountNo: acc.AccountNo, Currency: acc.Currency, From: args[1], To: args[2], OpeningBalance: zero, Entries: []Journal_Entry{}}
+
+	for _, e := range entries {
+		if e.Timestamp < start {
+			statement.OpeningBalance = e.Balance
+		} else if e.Timestamp < end {
+			statement.Entries = append(statement.Entries, e)
+		}
+	}
+
+	statement.ClosingBalance = statement.OpeningBalance
+	if len(statement.Entries) > 0 {
+		statement.ClosingBalance = statement.Entries[len(statement.Entries)-1].Balance
+	}
+
+	return json.Marshal(statement)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sreedhar310/learn-chaincode/identity"
+)
+
+// ============================================================================================================================
+// Account statuses. A frozen account can't be debited, and can't be credited either if the freeze blocks credits.
+// A closed account can't be used at all, but its record, journal and index entry are kept.
+// ============================================================================================================================
+const ACTIVE = "ACTIVE"
+const FROZEN = "FROZEN"
+const CLOSED = "CLOSED"
+
+// ============================================================================================================================
+// Index Entry - one account in the account index with its status, so closed accounts can be told apart without reading
+// every account
+// ============================================================================================================================
+type Index_Entry struct{
+	AccountNo string `json:"accountno"`
+	Status string `json:"status"`
+}
+
+// account_status - the status of an account. Accounts opened before statuses existed are active.
+func account_status(acc Account) string {
+	if acc.Status == "" {
+		return ACTIVE
+	}
+	return acc.Status
+}
+
+// ============================================================================================================================
+// check_debit / check_credit - fail if the account's status doesn't allow money to leave or arrive
+// ============================================================================================================================
+func check_debit(acc Account) error {
+	if account_status(acc) != ACTIVE {
+		return errors.New(fmt.Sprintf("Account %v is %v and can't be debited", acc.AccountNo, account_status(acc)))
+	}
+	return nil
+}
+
+func check_credit(acc Account) error {
+	status := account_status(acc)
+	if status == CLOSED || (status == FROZEN && acc.BlockCredits) {
+		return errors.New(fmt.Sprintf("Account %v is %v and can't be credited", acc.AccountNo, status))
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// retrieve_account_index - the account index. An index written before it moved to accountIndexStr is read from its old
+// key, and one written before statuses existed is a plain list of account numbers, which are all read as active.
+// ============================================================================================================================
+func (t *SimpleChaincode) retrieve_account_index(stub shim.ChaincodeStubInterface) ([]Index_Entry, error) {
+	var index []Index_Entry
+
+	accountsAsBytes, err := stub.GetState(accountIndexStr)
+	if err == nil && accountsAsBytes == nil {
+		accountsAsBytes, err = stub.GetState(legacyAccountIndexStr)
+	}
+	if err != nil {
+		return nil, errors.New("Failed to get account index")
+	}
+	if accountsAsBytes == nil {
+		return index, nil
+	}
+	if json.Unmarshal(accountsAsBytes, &index) == nil {
+		return index, nil
+	}
+
+	var legacy []string
+	err = json.Unmarshal(accountsAsBytes, &legacy)
+	if err != nil {
+		return nil, errors.New("Corrupt account index")
+	}
+	index = nil
+	for _, accountNo := range legacy {
+		index = append(index, Index_Entry{AccountNo: accountNo, Status: ACTIVE})
+	}
+	return index, nil
+}
+
+func (t *SimpleChaincode) save_account_index(stub shim.ChaincodeStubInterface, index []Index_Entry) error {
+	jsonAsBytes, _ := json.Marshal(index)
+	err := stub.PutState(accountIndexStr, jsonAsBytes)
+	if err != nil {
+		return err
+	}
+	return stub.DelState(legacyAccountIndexStr)								//the index has moved, so the old copy mustn't be read again
+}
+
+// ============================================================================================================================
+// set_status - change an account's status and keep the index in step
+// ============================================================================================================================
+func (t *SimpleChaincode) set_status(stub shim.ChaincodeStubInterface, acc Account, status string, blockCredits bool, reason string) error {
+	acc.Status = status
+	acc.BlockCredits = blockCredits
+	acc.StatusReason = reason
+
+	err := t.save_account(stub, acc)
+	if err != nil {
+		return err
+	}
+
+	index, err := t.retrieve_account_index(stub)
+	if err != nil {
+		return err
+	}
+	for i := range index {
+		if index[i].AccountNo == acc.AccountNo {
+			index[i].Status = status
+		}
+	}
+	return t.save_account_index(stub, index)
+}
+
+// ============================================================================================================================
+// Freeze account - compliance only. Debits are always blocked, credits only if the second argument is "true".
+// ============================================================================================================================
+func (t *SimpleChaincode) freeze_account(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//       0           1                2
+	// "accountNo", "true", "sanctions review"
+
+	err := identity.CheckArgs(args, 3)
+	if err != nil {
+		return nil, err
+	}
+	err = t.check_role(stub, caller, COMPLIANCE, "freeze_account")
+	if err != nil {
+		return nil, err
+	}
+
+	blockCredits, err := strconv.ParseBool(args[1])
+	if err != nil {
+		return nil, errors.New("2nd argument must be true or false")
+	}
+
+	acc, err := t.retrieve_account(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if account_status(acc) == CLOSED {
+		return nil, errors.New("Account " + acc.AccountNo + " is closed")
+	}
+
+	return nil, t.set_status(stub, acc, FROZEN, blockCredits, args[2])
+}
+
+// ============================================================================================================================
+// Unfreeze account - compliance only
+// ============================================================================================================================
+func (t *SimpleChaincode) unfreeze_account(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//       0
+	// "accountNo"
+
+	err := identity.CheckArgs(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	err = t.check_role(stub, caller, COMPLIANCE, "unfreeze_account")
+	if err != nil {
+		return nil, err
+	}
+
+	acc, err := t.retrieve_account(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if account_status(acc) != FROZEN {
+		return nil, errors.New("Account " + acc.AccountNo + " is not frozen")
+	}
+
+	return nil, t.set_status(stub, acc, ACTIVE, false, "")
+}
+
+// ============================================================================================================================
+// Close account - the owner closes an active account once its balance is zero
+// ============================================================================================================================
+func (t *SimpleChaincode) close_account(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//       0
+	// "accountNo"
+
+	err := identity.CheckArgs(args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	acc, err := t.retrieve_account(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if !is_owner(acc, caller) {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. close_account. %v !== %v", caller, acc.LegalEntity))
+	}
+	if account_status(acc) != ACTIVE {
+		return nil, errors.New(fmt.Sprintf("Account %v is %v and can't be closed", acc.AccountNo, account_status(acc)))
+	}
+
+	balance, err := strconv.ParseFloat(acc.Balance, 64)
+	if err != nil {
+		return nil, err
+	}
+	if balance != 0 {
+		return nil, errors.New("Account " + acc.AccountNo + " still holds a balance of " + acc.Balance)
+	}
+	held, err := parse_optional(acc.Held)
+	if err != nil || held != 0 {
+		return nil, errors.New("Account " + acc.AccountNo + " still has funds on hold")
+	}
+	accrued, err := parse_optional(acc.InterestAccrued)
+	if err != nil || accrued != 0 {
+		return nil, errors.New("Account " + acc.AccountNo + " has interest accrued that hasn't been posted yet")
+	}
+	owed, err := parse_optional(acc.OverdraftAccrued)
+	if err != nil || owed != 0 {
+		return nil, errors.New("Account " + acc.AccountNo + " has overdraft interest that hasn't been charged yet")
+	}
+	children, err := t.load_list(stub, children_key(acc.AccountNo))
+	if err != nil {
+		return nil, err
+	}
+	if len(children) > 0 {
+		return nil, errors.New("Account " + acc.AccountNo + " still has sub-accounts, move them out of the group first")
+	}
+
+	return nil, t.set_status(stub, acc, CLOSED, false, "closed by owner")
+}
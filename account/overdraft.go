@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sreedhar310/learn-chaincode/identity"
+	"github.com/sreedhar310/learn-chaincode/ledger"
+	"github.com/sreedhar310/learn-chaincode/validate"
+)
+
+// ============================================================================================================================
+// Overdrafts - an account with a credit limit may be debited down to minus that limit. Interest on the overdrawn
+// balance accrues at the account's yearly overdraft rate, to the second, before every change to the balance, and
+// charge_interest charges what has accrued to the account.
+// ============================================================================================================================
+const SECONDS_PER_DAY = 24 * 60 * 60
+const DAYS_PER_YEAR = 365
+
+// ============================================================================================================================
+// Funds - what get_available_funds reports for an account
+// ============================================================================================================================
+type Funds struct{
+	AccountNo string `json:"accountno"`
+	Currency string `json:"currency"`
+	Balance string `json:"balance"`
+	CreditLimit string `json:"creditlimit"`
+	Held string `json:"held"`
+	Available string `json:"available"`
+}
+
+func parse_optional(value string) (float64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.ParseFloat(value, 64)
+}
+
+// ============================================================================================================================
+// available_funds - how much can be debited from an account: its balance plus its credit limit, less its holds
+// ============================================================================================================================
+func available_funds(acc Account) (float64, error) {
+	balance, err := strconv.ParseFloat(acc.Balance, 64)
+	if err != nil {
+		return 0, errors.New("Corrupt balance on account " + acc.AccountNo)
+	}
+	limit, err := parse_optional(acc.CreditLimit)
+	if err != nil {
+		return 0, errors.New("Corrupt credit limit on account " + acc.AccountNo)
+	}
+	held, err := parse_optional(acc.Held)
+	if err != nil {
+		return 0, errors.New("Corrupt held amount on account " + acc.AccountNo)
+	}
+	return balance + limit - held, nil
+}
+
+// ============================================================================================================================
+// Set credit limit - agree an overdraft facility and its yearly interest rate. Credit officers only.
+// ============================================================================================================================
+func (t *SimpleChaincode) set_credit_limit(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//       0          1        2
+	// "accountNo", "10000", "0.12"
+
+	err := identity.CheckArgs(args, 3)
+	if err != nil {
+		return nil, err
+	}
+	err = t.check_role(stub, caller, CREDIT_OFFICER, "set_credit_limit")
+	if err != nil {
+		return nil, err
+	}
+
+	limit, err := validate.Balance(args[1])
+	if err != nil {
+		return nil, errors.New("Invalid credit limit: " + err.Error())
+	}
+	rate, err := validate.Rate(args[2])
+	if err != nil {
+		return nil, errors.New("Invalid overdraft rate: " + err.Error())
+	}
+
+	acc, err := t.retrieve_account(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if account_status(acc) == CLOSED {
+		return nil, errors.New("Account " + acc.AccountNo + " is closed")
+	}
+
+	now, err := t.get_tx_time(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// accrue interest at the old rate before the new one applies
+	acc, err = accrue_overdraft_interest(acc, now)
+	if err != nil {
+		return nil, err
+	}
+
+	acc.CreditLimit = strconv.FormatFloat(limit, 'E', -1, 64)
+	acc.OverdraftRate = strconv.FormatFloat(rate, 'E', -1, 64)
+	acc.InterestCharged = now
+
+	return nil, t.save_account(stub, acc)
+}
+
+// ============================================================================================================================
+// accrue_overdraft_interest - add the interest on an overdrawn balance since InterestCharged, when interest was last
+// accrued, to what the account owes
+// ============================================================================================================================
+func accrue_overdraft_interest(acc Account, now int64) (Account, error) {
+	if acc.InterestCharged == 0 || now <= acc.InterestCharged {
+		return acc, nil
+	}
+	elapsed := now - acc.InterestCharged
+	acc.InterestCharged = now
+
+	balance, err := strconv.ParseFloat(acc.Balance, 64)
+	if err != nil {
+		return acc, errors.New("Corrupt balance on account " + acc.AccountNo)
+	}
+	rate, err := parse_optional(acc.OverdraftRate)
+	if err != nil {
+		return acc, errors.New("Corrupt overdraft rate on account " + acc.AccountNo)
+	}
+	if balance >= 0 || rate <= 0 {
+		return acc, nil
+	}
+
+	accrued, err := parse_optional(acc.OverdraftAccrued)
+	if err != nil {
+		return acc, errors.New("Corrupt accrued overdraft interest on account " + acc.AccountNo)
+	}
+	accrued = accrued - balance * rate * float64(elapsed) / (DAYS_PER_YEAR * SECONDS_PER_DAY)
+	acc.OverdraftAccrued = strconv.FormatFloat(accrued, 'E', -1, 64)
+	return acc, nil
+}
+
+// ============================================================================================================================
+// charge_overdraft_interest - accrue overdraft interest up to now and charge all that has accrued to the account
+// ============================================================================================================================
+func (t *SimpleChaincode) charge_overdraft_interest(stub shim.ChaincodeStubInterface, acc Account, now int64) (Account, error) {
+	acc, err := accrue_overdraft_interest(acc, now)
+	if err != nil {
+		return acc, err
+	}
+	accrued, err := parse_optional(acc.OverdraftAccrued)
+	if err != nil {
+		return acc, errors.New("Corrupt accrued overdraft interest on account " + acc.AccountNo)
+	}
+	if accrued <= 0 {
+		return acc, nil
+	}
+	acc.OverdraftAccrued = ""
+
+	return t.charge(stub, acc, accrued, ledger.Interest, "overdraft interest")
+}
+
+// ============================================================================================================================
+// Charge interest - charge the interest accrued on an overdrawn account. Anyone may call it, the transaction timestamp
+// decides how much is due.
+// ============================================================================================================================
+func (t *SimpleChaincode) charge_interest(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//       0
+	// "accountNo"
+
+	err := identity.CheckArgs(args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	acc, err := t.retrieve_account(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if acc.InterestCharged == 0 {
+		return nil, errors.New("Account " + acc.AccountNo + " has no overdraft facility")
+	}
+
+	now, err := t.get_tx_time(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	acc, err = t.charge_overdraft_interest(stub, acc, now)
+	if err != nil {
+		return nil, err
+	}
+	return nil, t.save_account(stub, acc)
+}
+
+// ============================================================================================================================
+// Get available funds - the balance, credit limit, holds and funds available to debit. Visible to the owner and delegates.
+// ============================================================================================================================
+func (t *SimpleChaincode) get_available_funds(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//       0
+	// "accountNo"
+
+	err := identity.CheckArgs(args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	acc, err := t.retrieve_account(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if !is_owner(acc, caller) && find_delegate(acc, caller) < 0 {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. get_available_funds. %v !== %v", caller, acc.LegalEntity))
+	}
+
+	available, err := available_funds(acc)
+	if err != nil {
+		return nil, err
+	}
+	limit, _ := parse_optional(acc.CreditLimit)
+	held, _ := parse_optional(acc.Held)
+
+	return json.Marshal(Funds{
+		AccountNo: acc.AccountNo,
+		Currency: acc.Currency,
+		Balance: acc.Balance,
+		CreditLimit: strconv.FormatFloat(limit, 'E', -1, 64),
+		Held: strconv.FormatFloat(held, 'E', -1, 64),
+		Available: strconv.FormatFloat(available, 'E', -1, 64),
+	})
+}
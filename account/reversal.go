@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sreedhar310/learn-chaincode/identity"
+)
+
+// ============================================================================================================================
+// Reversals - every transfer is recorded under the ID of the transaction that made it, so it can be put right later by
+// a compensating transfer the other way. History is never edited: the reversal is a transfer of its own, linked to the
+// original both ways. A transaction can make several transfers, e.g. a batch, so each has a leg number in it.
+// ============================================================================================================================
+type Transfer_Record struct{
+	TxId string `json:"txid"`
+	Leg int `json:"leg"`
+	From string `json:"from"`
+	To string `json:"to"`
+	Debit string `json:"debit"`
+	DebitCurrency string `json:"debitcurrency"`
+	Credit string `json:"credit"`
+	CreditCurrency string `json:"creditcurrency"`
+	Memo string `json:"memo"`
+	ReversalOf string `json:"reversalof,omitempty"`
+	ReversedBy string `json:"reversedby,omitempty"`
+}
+
+func transfers_key(txId string) string {
+	return "transfer:" + txId
+}
+
+func (t *SimpleChaincode) retrieve_transfers(stub shim.ChaincodeStubInterface, txId string) ([]Transfer_Record, error) {
+	var records []Transfer_Record
+
+	recordsAsBytes, err := stub.GetState(transfers_key(txId))
+	if err != nil {
+		return nil, errors.New("Failed to get transfers for " + txId)
+	}
+	if recordsAsBytes == nil {
+		return records, nil
+	}
+	err = json.Unmarshal(recordsAsBytes, &records)
+	if err != nil {
+		return nil, errors.New("Corrupt transfers for " + txId)
+	}
+	return records, nil
+}
+
+func (t *SimpleChaincode) save_transfers(stub shim.ChaincodeStubInterface, txId string, records []Transfer_Record) error {
+	recordsAsBytes, err := json.Marshal(records)
+	if err != nil {
+		return errors.New("Error converting transfers for " + txId)
+	}
+	return stub.PutState(transfers_key(txId), recordsAsBytes)
+}
+
+// ============================================================================================================================
+// record_transfer - add a transfer to those made by the current transaction
+// ============================================================================================================================
+func (t *SimpleChaincode) record_transfer(stub shim.ChaincodeStubInterface, resA Account, resB Account, debit float64, credit float64, memo string) error {
+	txId := stub.GetTxID()
+	records, err := t.retrieve_transfers(stub, txId)
+	if err != nil {
+		return err
+	}
+	records = append(records, Transfer_Record{
+		TxId: txId,
+		Leg: len(records),
+		From: resA.AccountNo,
+		To: resB.AccountNo,
+		Debit: strconv.FormatFloat(debit, 'E', -1, 64),
+		DebitCurrency: resA.Currency,
+		Credit: strconv.FormatFloat(credit, 'E', -1, 64),
+		CreditCurrency: resB.Currency,
+		Memo: memo,
+	})
+	return t.save_transfers(stub, txId, records)
+}
+
+// ============================================================================================================================
+// Reverse transfer - send a completed transfer back. The recipient can consent to giving the money back by making the
+// reversal themselves, otherwise it takes the operations role. A transfer can only be reversed once, and a reversal
+// can't itself be reversed. An fx transfer is reversed at its original amounts, not at today's rate.
+// ============================================================================================================================
+func (t *SimpleChaincode) reverse_transfer(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//      0        1
+	// "txId", ["leg"]
+	// The leg is only needed when the transaction made more than one transfer
+
+	var err error
+	if len(args) != 2 {
+		err = identity.CheckArgs(args, 1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	txId := args[0]
+	records, err := t.retrieve_transfers(stub, txId)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("No transfers were made by transaction " + txId)
+	}
+
+	leg := 0
+	if len(args) == 2 {
+		leg, err = strconv.Atoi(args[1])
+		if err != nil || leg < 0 || leg >= len(records) {
+			return nil, errors.New(fmt.Sprintf("Transaction %v made %v transfers, leg must be between 0 and %v", txId, len(records), len(records) - 1))
+		}
+	} else if len(records) > 1 {
+		return nil, errors.New(fmt.Sprintf("Transaction %v made %v transfers, say which leg to reverse", txId, len(records)))
+	}
+	original := records[leg]
+
+	if original.ReversalOf != "" {
+		return nil, errors.New("Transfer is itself a reversal of " + original.ReversalOf + " and can't be reversed")
+	}
+	if original.ReversedBy != "" {
+		return nil, errors.New("Transfer was already reversed by " + original.ReversedBy)
+	}
+
+	resA, err := t.retrieve_account(stub, original.To)
+	if err != nil {
+		return nil, err
+	}
+	resB, err := t.retrieve_account(stub, original.From)
+	if err != nil {
+		return nil, err
+	}
+	held, err := t.get_roles(stub, caller)
+	if err != nil {
+		return nil, err
+	}
+	if !is_owner(resA, caller) && !has_role(held, OPERATIONS) {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. reverse_transfer. %v is neither the recipient %v nor %v", caller, resA.LegalEntity, OPERATIONS))
+	}
+
+	debit, _ := strconv.ParseFloat(original.Credit, 64)
+	credit, _ := strconv.ParseFloat(original.Debit, 64)
+	reversalTxId := stub.GetTxID()
+
+	err = t.move(stub, resA, resB, debit, credit, fmt.Sprintf("reversal of %v leg %v", txId, leg))
+	if err != nil {
+		return nil, err
+	}
+
+	// link the two transfers, move has just recorded the reversal as the last transfer of this transaction
+	reversals, err := t.retrieve_transfers(stub, reversalTxId)
+	if err != nil {
+		return nil, err
+	}
+	reversals[len(reversals) - 1].ReversalOf = txId + ":" + strconv.Itoa(leg)
+	err = t.save_transfers(stub, reversalTxId, reversals)
+	if err != nil {
+		return nil, err
+	}
+
+	records[leg].ReversedBy = reversalTxId + ":" + strconv.Itoa(len(reversals) - 1)
+	err = t.save_transfers(stub, txId, records)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(reversals[len(reversals) - 1])
+}
+
+// ============================================================================================================================
+// Get transfers - the transfers made by a transaction, with their reversal links. Visible to the owners of the accounts
+// involved, their delegates, and operations.
+// ============================================================================================================================
+func (t *SimpleChaincode) get_transfers(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//      0
+	// "txId"
+
+	err := identity.CheckArgs(args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := t.retrieve_transfers(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	held, err := t.get_roles(stub, caller)
+	if err != nil {
+		return nil, err
+	}
+	operations := has_role(held, OPERATIONS)
+
+	visible := []Transfer_Record{}
+	for _, record := range records {
+		if operations {
+			visible = append(visible, record)
+			continue
+		}
+		for _, accountNo := range []string{record.From, record.To} {
+			acc, err := t.retrieve_account(stub, accountNo)
+			if err == nil && (is_owner(acc, caller) || find_delegate(acc, caller) >= 0) {
+				visible = append(visible, record)
+				break
+			}
+		}
+	}
+	return json.Marshal(visible)
+}
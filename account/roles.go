@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sreedhar310/learn-chaincode/identity"
+	"github.com/sreedhar310/learn-chaincode/validate"
+)
+
+// ============================================================================================================================
+// Roles - the network roles an identity can hold on top of owning accounts. They are assigned in pairs of name and
+// role when the chaincode is deployed, and by an admin afterwards.
+// ============================================================================================================================
+const ADMIN = "admin"
+const FX_ORACLE = "fx_oracle"
+const COMPLIANCE = "compliance"
+const CREDIT_OFFICER = "credit_officer"
+const ISSUER = "issuer"
+const OPERATIONS = "operations"
+
+var roles = []string{ADMIN, FX_ORACLE, COMPLIANCE, CREDIT_OFFICER, ISSUER, OPERATIONS}
+
+func role_key(name string) string {
+	return "roles:" + strings.ToLower(name)
+}
+
+// ============================================================================================================================
+// get_roles - the roles held by an identity, empty if it has none
+// ============================================================================================================================
+func (t *SimpleChaincode) get_roles(stub shim.ChaincodeStubInterface, name string) ([]string, error) {
+	var held []string
+
+	rolesAsBytes, err := stub.GetState(role_key(name))
+	if err != nil {
+		return nil, errors.New("Failed to get roles for " + name)
+	}
+	if rolesAsBytes == nil {
+		return held, nil
+	}
+	err = json.Unmarshal(rolesAsBytes, &held)
+	if err != nil {
+		return nil, errors.New("Corrupt roles record for " + name)
+	}
+	return held, nil
+}
+
+func has_role(held []string, role string) bool {
+	for _, r := range held {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// ============================================================================================================================
+// check_role - fails unless the caller holds the role
+// ============================================================================================================================
+func (t *SimpleChaincode) check_role(stub shim.ChaincodeStubInterface, caller string, role string, function string) error {
+	held, err := t.get_roles(stub, caller)
+	if err != nil {
+		return err
+	}
+	if !has_role(held, role) {
+		return errors.New(fmt.Sprintf("Permission Denied. %v. %v is not %v", function, caller, role))
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// set_role - add or remove one role for an identity
+// ============================================================================================================================
+func (t *SimpleChaincode) set_role(stub shim.ChaincodeStubInterface, name string, role string, grant bool) error {
+	err := validate.Name(name)
+	if err != nil {
+		return errors.New("Invalid name: " + err.Error())
+	}
+	if !has_role(roles, role) {
+		return errors.New("Unknown role: " + role)
+	}
+
+	held, err := t.get_roles(stub, name)
+	if err != nil {
+		return err
+	}
+
+	var updated []string
+	for _, r := range held {
+		if r != role {
+			updated = append(updated, r)
+		}
+	}
+	if grant {
+		updated = append(updated, role)
+	}
+
+	rolesAsBytes, _ := json.Marshal(updated)
+	return stub.PutState(role_key(name), rolesAsBytes)
+}
+
+// ============================================================================================================================
+// Grant role / Revoke role - admin only
+// ============================================================================================================================
+func (t *SimpleChaincode) grant_role(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//     0          1
+	// "alice", "fx_oracle"
+
+	err := identity.CheckArgs(args, 2)
+	if err != nil {
+		return nil, err
+	}
+	err = t.check_role(stub, caller, ADMIN, "grant_role")
+	if err != nil {
+		return nil, err
+	}
+	return nil, t.set_role(stub, args[0], args[1], true)
+}
+
+func (t *SimpleChaincode) revoke_role(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//     0          1
+	// "alice", "fx_oracle"
+
+	err := identity.CheckArgs(args, 2)
+	if err != nil {
+		return nil, err
+	}
+	err = t.check_role(stub, caller, ADMIN, "revoke_role")
+	if err != nil {
+		return nil, err
+	}
+	if strings.ToLower(args[0]) == strings.ToLower(caller) && args[1] == ADMIN {
+		return nil, errors.New("An admin can't revoke their own admin role")
+	}
+	return nil, t.set_role(stub, args[0], args[1], false)
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sreedhar310/learn-chaincode/identity"
+	"github.com/sreedhar310/learn-chaincode/validate"
+)
+
+// ============================================================================================================================
+// Standing Orders - recurring transfers between two accounts. The schedule is "daily", "weekly", "monthly" or a number
+// of seconds, counted from the start date. Period n of an order is due at start + n intervals, and run_due_payments
+// makes one attempt at each period that has come due, so no period is ever paid twice. A period that can't be paid is
+// recorded as a failure and not retried.
+// ============================================================================================================================
+const ORDER_ACTIVE = "ACTIVE"
+const ORDER_ENDED = "ENDED"
+const ORDER_CANCELLED = "CANCELLED"
+
+// MAX_PERIODS_PER_RUN stops one run catching up an unbounded number of missed periods for one order
+const MAX_PERIODS_PER_RUN = 12
+
+var orderIndexStr = "index:standingorders"			// the IDs of every active standing order
+
+type Standing_Order struct{
+	OrderId string `json:"orderid"`
+	Source string `json:"source"`
+	Destination string `json:"destination"`
+	Amount string `json:"amount"`
+	Schedule string `json:"schedule"`
+	Start int64 `json:"start"`
+	End int64 `json:"end,omitempty"`
+	Periods int `json:"periods"`
+	Status string `json:"status"`
+	CreatedBy string `json:"createdby"`
+	Failures []Order_Failure `json:"failures,omitempty"`
+}
+
+type Order_Failure struct{
+	TxId string `json:"txid"`
+	Period int `json:"period"`
+	Due int64 `json:"due"`
+	Reason string `json:"reason"`
+}
+
+// Payment_Result - what run_due_payments reports for each period it attempted
+type Payment_Result struct{
+	OrderId string `json:"orderid"`
+	Period int `json:"period"`
+	Due int64 `json:"due"`
+	Paid bool `json:"paid"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func order_key(orderId string) string {
+	return "standingorder:" + orderId
+}
+
+func account_orders_key(accountNo string) string {
+	return "standingorders:" + accountNo
+}
+
+// ============================================================================================================================
+// period_due - when period n of an order falls due
+// ============================================================================================================================
+func period_due(schedule string, start int64, n int) (int64, error) {
+	switch schedule {
+	case "daily":
+		return start + int64(n) * SECONDS_PER_DAY, nil
+	case "weekly":
+		return start + int64(n) * 7 * SECONDS_PER_DAY, nil
+	case "monthly":
+		return time.Unix(start, 0).UTC().AddDate(0, n, 0).Unix(), nil
+	}
+	interval, err := strconv.ParseInt(schedule, 10, 64)
+	if err != nil || interval < 60 {
+		return 0, errors.New("Schedule must be daily, weekly, monthly or a number of seconds of at least 60")
+	}
+	return start + int64(n) * interval, nil
+}
+
+func (t *SimpleChaincode) retrieve_order(stub shim.ChaincodeStubInterface, orderId string) (Standing_Order, error) {
+	var order Standing_Order
+
+	orderAsBytes, err := stub.GetState(order_key(orderId))
+	if err != nil {
+		return order, errors.New("Failed to get standing order " + orderId)
+	}
+	if orderAsBytes == nil {
+		return order, errors.New("Standing order " + orderId + " does not exist")
+	}
+	err = json.Unmarshal(orderAsBytes, &order)
+	if err != nil {
+		return order, errors.New("Corrupt standing order " + orderId)
+	}
+	return order, nil
+}
+
+func (t *SimpleChaincode) save_order(stub shim.ChaincodeStubInterface, order Standing_Order) error {
+	orderAsBytes, _ := json.Marshal(order)
+	return stub.PutState(order_key(order.OrderId), orderAsBytes)
+}
+
+// remove_order - take an order that has ended or been cancelled out of the active index
+func (t *SimpleChaincode) remove_order(stub shim.ChaincodeStubInterface, orderId string) error {
+	active, err := t.load_list(stub, orderIndexStr)
+	if err != nil {
+		return err
+	}
+	for i, id := range active {
+		if id == orderId {
+			active = append(active[:i], active[i+1:]...)
+			break
+		}
+	}
+	return t.save_list(stub, orderIndexStr, active)
+}
+
+// ============================================================================================================================
+// Create standing order - made by the owner or a delegate of the source account, and returns the order ID. The end
+// date is optional, and both dates are UTC and inclusive.
+// ============================================================================================================================
+func (t *SimpleChaincode) create_standing_order(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//       0            1          2          3             4              5
+	// "accountA", "accountB", "950.00", "monthly", "2017-02-01", "2017-12-31" (optional)
+
+	if len(args) != 5 && len(args) != 6 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 5 or 6")
+	}
+
+	amount, err := validate.Money(args[2])
+	if err != nil {
+		return nil, errors.New("3rd argument must be a positive amount with at most two decimal places")
+	}
+	if _, err = period_due(args[3], 0, 1); err != nil {
+		return nil, err
+	}
+	start, err := time.Parse(STATEMENT_DATE, args[4])
+	if err != nil {
+		return nil, errors.New("Invalid start date, expecting " + STATEMENT_DATE)
+	}
+
+	var end int64
+	if len(args) == 6 {
+		last, err := time.Parse(STATEMENT_DATE, args[5])
+		if err != nil {
+			return nil, errors.New("Invalid end date, expecting " + STATEMENT_DATE)
+		}
+		if last.Before(start) {
+			return nil, errors.New("The end date is before the start date")
+		}
+		end = last.AddDate(0, 0, 1).Unix()
+	}
+
+	if args[0] == args[1] {
+		return nil, errors.New("Can't pay an account from itself")
+	}
+	src, err := t.retrieve_account(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := t.retrieve_account(stub, args[1])
+	if err != nil {
+		return nil, err
+	}
+	if src.Currency != dst.Currency {
+		return nil, errors.New(fmt.Sprintf("Currency mismatch. %v is in %v and %v is in %v", src.AccountNo, src.Currency, dst.AccountNo, dst.Currency))
+	}
+	if !is_owner(src, caller) && find_delegate(src, caller) < 0 {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. create_standing_order. %v !== %v", caller, src.LegalEntity))
+	}
+
+	order := Standing_Order{
+		OrderId: stub.GetTxID(),
+		Source: src.AccountNo,
+		Destination: dst.AccountNo,
+		Amount: strconv.FormatFloat(amount, 'E', -1, 64),
+		Schedule: args[3],
+		Start: start.Unix(),
+		End: end,
+		Status: ORDER_ACTIVE,
+		CreatedBy: caller,
+	}
+	err = t.save_order(stub, order)
+	if err != nil {
+		return nil, err
+	}
+
+	orders, err := t.load_list(stub, account_orders_key(src.AccountNo))
+	if err != nil {
+		return nil, err
+	}
+	err = t.save_list(stub, account_orders_key(src.AccountNo), append(orders, order.OrderId))
+	if err != nil {
+		return nil, err
+	}
+
+	active, err := t.load_list(stub, orderIndexStr)
+	if err != nil {
+		return nil, err
+	}
+	err = t.save_list(stub, orderIndexStr, append(active, order.OrderId))
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(order.OrderId), nil
+}
+
+// ============================================================================================================================
+// Cancel standing order - by the owner of the source account or whoever created the order
+// ============================================================================================================================
+func (t *SimpleChaincode) cancel_standing_order(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//     0
+	// "orderId"
+
+	err := identity.CheckArgs(args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := t.retrieve_order(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if order.Status != ORDER_ACTIVE {
+		return nil, errors.New("Standing order " + order.OrderId + " is " + order.Status)
+	}
+
+	src, err := t.retrieve_account(stub, order.Source)
+	if err != nil {
+		return nil, err
+	}
+	if !is_owner(src, caller) && order.CreatedBy != caller {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. cancel_standing_order. %v !== %v", caller, src.LegalEntity))
+	}
+
+	order.Status = ORDER_CANCELLED
+	err = t.save_order(stub, order)
+	if err != nil {
+		return nil, err
+	}
+	return nil, t.remove_order(stub, order.OrderId)
+}
+
+// ============================================================================================================================
+// pay_period - attempt one period of an order. Anything that stops the payment, such as insufficient funds, a frozen
+// account or a revoked delegate, is checked before any state is written and comes back as the reason. An error is
+// only returned when writing the payment fails, and aborts the run.
+// ============================================================================================================================
+func (t *SimpleChaincode) pay_period(stub shim.ChaincodeStubInterface, order Standing_Order, due int64) (string, error) {
+	amount, err := strconv.ParseFloat(order.Amount, 64)
+	if err != nil {
+		return "", errors.New("Corrupt amount on standing order " + order.OrderId)
+	}
+
+	src, err := t.retrieve_account(stub, order.Source)
+	if err != nil {
+		return err.Error(), nil
+	}
+	dst, err := t.retrieve_account(stub, order.Destination)
+	if err != nil {
+		return err.Error(), nil
+	}
+	if err = check_debit(src); err != nil {
+		return err.Error(), nil
+	}
+	if err = check_credit(dst); err != nil {
+		return err.Error(), nil
+	}
+	if err = authorize_debit(&src, order.CreatedBy, amount); err != nil {
+		return err.Error(), nil
+	}
+	available, err := available_funds(src)
+	if err != nil {
+		return "", err
+	}
+	if amount > available {
+		return src.AccountNo + " doesn't have enough available funds", nil
+	}
+
+	memo := fmt.Sprintf("standing order %v period %v", order.OrderId, time.Unix(due, 0).UTC().Format(STATEMENT_DATE))
+	return "", t.move(stub, src, dst, amount, amount, memo)
+}
+
+// ============================================================================================================================
+// Run due payments - pay every period of every active standing order that has come due by the transaction timestamp.
+// Called by an external scheduler, anyone may call it. Returns what happened to each period attempted.
+// ============================================================================================================================
+func (t *SimpleChaincode) run_due_payments(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	err := identity.CheckArgs(args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := t.get_tx_time(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	active, err := t.load_list(stub, orderIndexStr)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []Payment_Result{}
+
+	for _, id := range active {
+		order, err := t.retrieve_order(stub, id)
+		if err != nil {
+			return nil, err
+		}
+
+		for attempts := 0; attempts < MAX_PERIODS_PER_RUN; attempts++ {
+			due, err := period_due(order.Schedule, order.Start, order.Periods)
+			if err != nil {
+				return nil, err
+			}
+			if order.End != 0 && due >= order.End {
+				order.Status = ORDER_ENDED
+				break
+			}
+			if due > now {
+				break
+			}
+
+			reason, err := t.pay_period(stub, order, due)
+			if err != nil {
+				return nil, err
+			}
+
+			result := Payment_Result{OrderId: order.OrderId, Period: order.Periods, Due: due, Paid: reason == "", Reason: reason}
+			if reason != "" {
+				order.Failures = append(order.Failures, Order_Failure{TxId: stub.GetTxID(), Period: order.Periods, Due: due, Reason: reason})
+			}
+			results = append(results, result)
+			order.Periods++
+		}
+
+		err = t.save_order(stub, order)
+		if err != nil {
+			return nil, err
+		}
+		if order.Status == ORDER_ENDED {
+			err = t.remove_order(stub, order.OrderId)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return json.Marshal(results)
+}
+
+// ============================================================================================================================
+// Get standing orders - the standing orders paid from an account. Visible to the owner and delegates.
+// ============================================================================================================================
+func (t *SimpleChaincode) get_standing_orders(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//       0
+	// "accountNo"
+
+	err := identity.CheckArgs(args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	acc, err := t.retrieve_account(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if !is_owner(acc, caller) && find_delegate(acc, caller) < 0 {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. get_standing_orders. %v !== %v", caller, acc.LegalEntity))
+	}
+
+	ids, err := t.load_list(stub, account_orders_key(acc.AccountNo))
+	if err != nil {
+		return nil, err
+	}
+
+	orders := []Standing_Order{}
+	for _, id := range ids {
+		order, err := t.retrieve_order(stub, id)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	return json.Marshal(orders)
+}
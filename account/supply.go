@@ -0,0 +1,280 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sreedhar310/learn-chaincode/identity"
+	"github.com/sreedhar310/learn-chaincode/ledger"
+	"github.com/sreedhar310/learn-chaincode/validate"
+)
+
+// ============================================================================================================================
+// Supply - money only enters the accounts through mint and leaves through burn, both issuer only. The total supply of
+// each currency is kept alongside, and anything else that moves money in or out of the customer accounts, such as
+// charges and fx transfers, adjusts it too, so the balances of the indexed accounts always add up to it.
+// ============================================================================================================================
+var totalSupplyStr = "supply:total"
+
+// SUPPLY_TOLERANCE is how far the balances may drift from the supply through float rounding
+const SUPPLY_TOLERANCE = 1e-6
+
+type Supply_Check struct{
+	Currency string `json:"currency"`
+	Supply string `json:"supply"`
+	Balances string `json:"balances"`
+	Difference string `json:"difference"`
+	Ok bool `json:"ok"`
+}
+
+type Invariant_Report struct{
+	Ok bool `json:"ok"`
+	Accounts int `json:"accounts"`
+	Currencies []Supply_Check `json:"currencies"`
+}
+
+// ============================================================================================================================
+// retrieve_supply - the total supply of each currency that has one
+// ============================================================================================================================
+func (t *SimpleChaincode) retrieve_supply(stub shim.ChaincodeStubInterface) (map[string]string, error) {
+	supply := map[string]string{}
+
+	supplyAsBytes, err := stub.GetState(totalSupplyStr)
+	if err != nil {
+		return nil, errors.New("Failed to get total supply")
+	}
+	if supplyAsBytes == nil {
+		return supply, nil
+	}
+	err = json.Unmarshal(supplyAsBytes, &supply)
+	if err != nil {
+		return nil, errors.New("Corrupt total supply")
+	}
+	return supply, nil
+}
+
+func (t *SimpleChaincode) save_supply(stub shim.ChaincodeStubInterface, supply map[string]string) error {
+	supplyAsBytes, err := json.Marshal(supply)
+	if err != nil {
+		return errors.New("Error converting total supply")
+	}
+	return stub.PutState(totalSupplyStr, supplyAsBytes)
+}
+
+// ============================================================================================================================
+// adjust_supply - add to the supply of a currency, or take from it with a negative amount
+// ============================================================================================================================
+func (t *SimpleChaincode) adjust_supply(stub shim.ChaincodeStubInterface, currency string, amount float64) error {
+	supply, err := t.retrieve_supply(stub)
+	if err != nil {
+		return err
+	}
+	total, err := parse_optional(supply[currency])
+	if err != nil {
+		return errors.New("Corrupt total supply of " + currency)
+	}
+	supply[currency] = strconv.FormatFloat(total + amount, 'E', -1, 64)
+	return t.save_supply(stub, supply)
+}
+
+// ============================================================================================================================
+// Mint - create money in an account. Issuers only.
+// ============================================================================================================================
+func (t *SimpleChaincode) mint(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//       0          1
+	// "accountNo", "1000"
+
+	err := identity.CheckArgs(args, 2)
+	if err != nil {
+		return nil, err
+	}
+	err = t.check_role(stub, caller, ISSUER, "mint")
+	if err != nil {
+		return nil, err
+	}
+	amount, err := validate.Money(args[1])
+	if err != nil {
+		return nil, errors.New("Amount must be a positive amount with at most two decimal places")
+	}
+
+	acc, err := t.retrieve_account(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	err = check_credit(acc)
+	if err != nil {
+		return nil, err
+	}
+	acc, err = t.accrue(stub, acc)
+	if err != nil {
+		return nil, err
+	}
+
+	balance, err := strconv.ParseFloat(acc.Balance, 64)
+	if err != nil {
+		return nil, errors.New("Corrupt balance on account " + acc.AccountNo)
+	}
+	balance = balance + amount
+	acc.Balance = strconv.FormatFloat(balance, 'E', -1, 64)
+
+	err = t.save_account(stub, acc)
+	if err != nil {
+		return nil, err
+	}
+	err = t.adjust_supply(stub, acc.Currency, amount)
+	if err != nil {
+		return nil, err
+	}
+	err = t.journal(stub, acc.AccountNo, "", amount, balance, "mint")
+	if err != nil {
+		return nil, err
+	}
+	return nil, ledger.Post(stub, "mint " + acc.AccountNo,
+		ledger.Debit(ledger.Issuance, acc.Currency, amount),
+		ledger.Credit(ledger.Customer(acc.AccountNo), acc.Currency, amount))
+}
+
+// ============================================================================================================================
+// Burn - destroy money held in an account. Issuers only, and only out of the funds available, so held funds and the
+// credit limit can't be burnt.
+// ============================================================================================================================
+func (t *SimpleChaincode) burn(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//       0          1
+	// "accountNo", "1000"
+
+	err := identity.CheckArgs(args, 2)
+	if err != nil {
+		return nil, err
+	}
+	err = t.check_role(stub, caller, ISSUER, "burn")
+	if err != nil {
+		return nil, err
+	}
+	amount, err := validate.Money(args[1])
+	if err != nil {
+		return nil, errors.New("Amount must be a positive amount with at most two decimal places")
+	}
+
+	acc, err := t.retrieve_account(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	err = check_debit(acc)
+	if err != nil {
+		return nil, err
+	}
+	acc, err = t.accrue(stub, acc)
+	if err != nil {
+		return nil, err
+	}
+
+	balance, err := strconv.ParseFloat(acc.Balance, 64)
+	if err != nil {
+		return nil, errors.New("Corrupt balance on account " + acc.AccountNo)
+	}
+	held, err := parse_optional(acc.Held)
+	if err != nil {
+		return nil, errors.New("Corrupt held amount on account " + acc.AccountNo)
+	}
+	if amount > balance - held {
+		return nil, errors.New(acc.AccountNo + " doesn't have enough funds to burn")
+	}
+	balance = balance - amount
+	acc.Balance = strconv.FormatFloat(balance, 'E', -1, 64)
+
+	err = t.save_account(stub, acc)
+	if err != nil {
+		return nil, err
+	}
+	err = t.adjust_supply(stub, acc.Currency, -amount)
+	if err != nil {
+		return nil, err
+	}
+	err = t.journal(stub, acc.AccountNo, "", -amount, balance, "burn")
+	if err != nil {
+		return nil, err
+	}
+	return nil, ledger.Post(stub, "burn " + acc.AccountNo,
+		ledger.Debit(ledger.Customer(acc.AccountNo), acc.Currency, amount),
+		ledger.Credit(ledger.Issuance, acc.Currency, amount))
+}
+
+// ============================================================================================================================
+// Get total supply - the money in circulation in each currency
+// ============================================================================================================================
+func (t *SimpleChaincode) get_total_supply(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	supply, err := t.retrieve_supply(stub)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(supply)
+}
+
+// ============================================================================================================================
+// Check invariants - add up the balances of every account in the index by currency and compare them with the total
+// supply. Any currency with balances but no supply, or supply but no balances, is reported too.
+// ============================================================================================================================
+func (t *SimpleChaincode) check_invariants(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	supply, err := t.retrieve_supply(stub)
+	if err != nil {
+		return nil, err
+	}
+	index, err := t.retrieve_account_index(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	balances := map[string]float64{}
+	for _, entry := range index {
+		acc, err := t.retrieve_account(stub, entry.AccountNo)
+		if err != nil {
+			return nil, err
+		}
+		balance, err := strconv.ParseFloat(acc.Balance, 64)
+		if err != nil {
+			return nil, errors.New("Corrupt balance on account " + acc.AccountNo)
+		}
+		balances[acc.Currency] += balance
+	}
+
+	var currencies []string
+	for currency := range balances {
+		currencies = append(currencies, currency)
+	}
+	for currency := range supply {
+		if _, ok := balances[currency]; !ok {
+			currencies = append(currencies, currency)
+		}
+	}
+	sort.Strings(currencies)
+
+	report := Invariant_Report{Ok: true, Accounts: len(index)}
+	for _, currency := range currencies {
+		total, err := parse_optional(supply[currency])
+		if err != nil {
+			return nil, errors.New("Corrupt total supply of " + currency)
+		}
+		difference := balances[currency] - total
+		check := Supply_Check{
+			Currency: currency,
+			Supply: strconv.FormatFloat(total, 'E', -1, 64),
+			Balances: strconv.FormatFloat(balances[currency], 'E', -1, 64),
+			Difference: strconv.FormatFloat(difference, 'E', -1, 64),
+			Ok: math.Abs(difference) <= SUPPLY_TOLERANCE,
+		}
+		if !check.Ok {
+			fmt.Println("! supply invariant broken for " + currency)
+			report.Ok = false
+		}
+		report.Currencies = append(report.Currencies, check)
+	}
+
+	return json.Marshal(report)
+}
@@ -1,333 +1,340 @@
-package main
-
-import (
-	"fmt"
-	"strconv"
-	"encoding/json"
-	"strings"
-
-	"github.com/hyperledger/fabric/core/chaincode/shim"
-	"errors"
-)
-
-//==============================================================================================================================
-//	Structure Definitions
-//==============================================================================================================================
-//	Chaincode - A blank struct for use with Shim (A HyperLedger included go file used for get/put state
-//				and other HyperLedger functions)
-//==============================================================================================================================
-type  SimpleChaincode struct {
-}		
-
-//==============================================================================================================================
-//	Account - Defines the structure for an account object. JSON on right tells it what JSON fields to map to
-//			  that element when reading a JSON object into the struct e.g. JSON currency -> Struct Currency
-//==============================================================================================================================
-type Account struct{
-	AccountNo string `json:"accountno"`	
-	LegalEntity string `json:"legalentity"`
-	Currency string `json:"currency"`				
-	Balance string `json:"balance"`
-}
-
-var accountIndexStr = "_accountindex"	  // Define an index varibale to track all the accounts stored in the world state
-
-// ============================================================================================================================
-//  Main - main - Starts up the chaincode
-// ============================================================================================================================
-func main() {
-	err := shim.Start(new(SimpleChaincode))
-	if err != nil {
-		fmt.Printf("Error starting Simple chaincode: %s", err)
-	}
-}
-
-// ============================================================================================================================
-// Init Function - Called when the user deploys the chaincode
-// ============================================================================================================================
-func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	var Aval int
-	var err error
-
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting a single integer")
-	}
-
-	// Initialize the chaincode
-	Aval, err = strconv.Atoi(args[0])
-	if err != nil {
-		return nil, errors.New("Expecting integer value for testing the blockchain network")
-	}
-
-	// Write the state to the ledger, test the network
-	err = stub.PutState("test_key", []byte(strconv.Itoa(Aval)))	
-	if err != nil {
-		return nil, err
-	}
-	
-	var empty []string
-	jsonAsBytes, _ := json.Marshal(empty)								//marshal an emtpy array of strings to clear the account index
-	err = stub.PutState(accountIndexStr, jsonAsBytes)
-	if err != nil {
-		return nil, err
-	}
-	
-	return nil, nil
-}
-
-// ============================================================================================================================
-// Invoke - Called on chaincode invoke. Takes a function name passed and calls that function. Converts some
-//		    initial arguments passed to other things for use in the called function.
-// ============================================================================================================================
-func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-
-	// Handle different functions
-	if function == "init" {										//initialize the chaincode state, used as reset
-		return t.Init(stub, "init", args)
-	} else if function == "delete" {									
-		return t.Delete(stub, args)												
-	} else if function == "write" {									
-		return t.Write(stub, args)
-	} else if function == "init_account" {									
-		return t.init_account(stub, args)
-	} else if function == "transfer_balance" {									
-		return t.transfer_balance(stub, args)										
-	}
-	fmt.Errorf("invoke did not find func: " + function)					//error
-
-	return nil, errors.New("Received unknown function invocation: " + function)
-}
-
-// ============================================================================================================================
-//	Query - Called on chaincode query. Takes a function name passed and calls that function. Passes the
-//  		initial arguments passed are passed on to the called function.
-// ============================================================================================================================
-func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-
-	if function == "read" {												
-		return t.read(stub, args)
-	}
-	fmt.Println("query did not find func: " + function)						//error
-
-	return nil, errors.New("Received unknown function query " + function)
-}
-
-// ============================================================================================================================
-// Read - read a variable from chaincode world state
-// ============================================================================================================================
-func (t *SimpleChaincode) read(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var name, jsonResp string
-	var err error
-
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting name of the var to query")
-	}
-
-	name = args[0]
-	valAsbytes, err := stub.GetState(name)	
-	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + name + "\"}"
-		return nil, errors.New(jsonResp)
-	}
-
-	return valAsbytes, nil												
-}
-
-// ============================================================================================================================
-// Delete - remove a key/value pair from the world state
-// ============================================================================================================================
-func (t *SimpleChaincode) Delete(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
-	}
-	
-	name := args[0]
-	err := stub.DelState(name)													//remove the key from chaincode state
-	if err != nil {
-		return nil, errors.New("Failed to delete state")
-	}
-
-	//get the account index
-	accountsAsBytes, err := stub.GetState(accountIndexStr)
-	if err != nil {
-		return nil, errors.New("Failed to get account index")
-	}
-	var accountIndex []string
-	json.Unmarshal(accountsAsBytes, &accountIndex)						
-	
-	//remove account from index
-	for i,val := range accountIndex{
-		if val == name{															//find the correct account
-			accountIndex = append(accountIndex[:i], accountIndex[i+1:]...)			//remove it
-			break
-		}
-	}
-	jsonAsBytes, _ := json.Marshal(accountIndex)									//save the new index
-	err = stub.PutState(accountIndexStr, jsonAsBytes)
-	return nil, nil
-}
-
-// ============================================================================================================================
-// Write - directly write a variable into chaincode world state
-// ============================================================================================================================
-func (t *SimpleChaincode) Write(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var name, value string 
-	var err error
-
-	if len(args) != 2 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 2. name of the variable and value to set")
-	}
-
-	name = args[0]														
-	value = args[1]
-	err = stub.PutState(name, []byte(value))					
-	if err != nil {
-		return nil, err
-	}
-	return nil, nil
-}
-
-// ============================================================================================================================
-// Init account - create a new account, store into chaincode world state, and then append the account index
-// ============================================================================================================================
-func (t *SimpleChaincode) init_account(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var err error
-
-	//       0        1      2      3
-	// "accountNo", "bob", "USD", "3500"
-
-	if len(args) != 4 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 4")
-	}
-
-	//input sanitation
-	fmt.Println("- start init acount")
-	if len(args[0]) <= 0 {
-		return nil, errors.New("1st argument must be a non-empty string")
-	}
-	if len(args[1]) <= 0 {
-		return nil, errors.New("2nd argument must be a non-empty string")
-	}
-	if len(args[2]) <= 0 {
-		return nil, errors.New("3rd argument must be a non-empty string")
-	}
-	if len(args[3]) <= 0 {
-		return nil, errors.New("3rd argument must be a non-empty string")
-	}
-
-	accountNo := args[0]
-
-	legalEntity := strings.ToLower(args[1])
-
-	currency := args[2]
-
-	ammount, err := strconv.ParseFloat(args[3],64)
-	if err != nil {
-		return nil, errors.New("4rd argument must be a numeric string")
-	}
-
-	//check if account already exists
-	accountAsBytes, err := stub.GetState(accountNo)
-	if err != nil {
-		return nil, errors.New("Failed to get account number")
-	}
-	res := Account{}
-	json.Unmarshal(accountAsBytes, &res)
-	if res.AccountNo == accountNo{
-		return nil, errors.New("This account arleady exists")			
-	}
-	amountStr := strconv.FormatFloat(ammount, 'E', -1, 64)
-
-	//build the account json string 
-	str := `{"accountno": "` + accountNo + `", "legalentity": "` + legalEntity + `", "currency": "` + currency + `", "balance": "` + amountStr + `"}`
-	err = stub.PutState(accountNo, []byte(str))							
-	if err != nil {
-		return nil, err
-	}
-		
-	//get the account index
-	accountsAsBytes, err := stub.GetState(accountIndexStr)
-	if err != nil {
-		return nil, errors.New("Failed to get account index")
-	}
-	var accountIndex []string
-	json.Unmarshal(accountsAsBytes, &accountIndex)							
-	
-	//append the index 
-	accountIndex = append(accountIndex, accountNo)	
-	jsonAsBytes, _ := json.Marshal(accountIndex)
-	err = stub.PutState(accountIndexStr, jsonAsBytes)						
-
-	return nil, nil
-}
-
-// ============================================================================================================================
-// Transfer Balance - Create a transaction between two accounts, transfer a certain amount of balance
-// ============================================================================================================================
-func (t *SimpleChaincode) transfer_balance(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	
-	//       0           1         2
-	// "accountA", "accountB", "100.20"
-
-	var err error
-	var newAmountA, newAmountB float64
-
-	if len(args) < 3 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 3")
-	}
-
-	amount,err := strconv.ParseFloat(args[2], 64)
-	if err != nil {
-		return nil, errors.New("3rd argument must be a numeric string")
-	}
-
-	accountAAsBytes, err := stub.GetState(args[0])
-	if err != nil {
-		return nil, errors.New("Failed to get the first account")
-	}
-	resA := Account{}
-	json.Unmarshal(accountAAsBytes, &resA)								
-	
-	accountBAsBytes, err := stub.GetState(args[1])
-	if err != nil {
-		return nil, errors.New("Failed to get the second account")
-	}
-	resB := Account{}
-	json.Unmarshal(accountBAsBytes, &resB)											
-	
-	BalanceA,err := strconv.ParseFloat(resA.Balance, 64)
-	if err != nil {
-		return nil, err
-	}
-	BalanceB,err := strconv.ParseFloat(resB.Balance, 64)
-	if err != nil {
-		return nil, err
-	}
-
-	//Check if accountA has enough balance to transact or not
-	if (BalanceA - amount) < 0 {
-		return nil, errors.New(args[0] + " doesn't have enough balance to complete transaction")
-	}
-
-	newAmountA = BalanceA - amount
-	newAmountB =  BalanceB + amount
-	newAmountStrA := strconv.FormatFloat(newAmountA, 'E', -1, 64)
-	newAmountStrB := strconv.FormatFloat(newAmountB, 'E', -1, 64)
-
-	resA.Balance = newAmountStrA
-	resB.Balance = newAmountStrB
-
-	jsonAAsBytes, _ := json.Marshal(resA)
-	err = stub.PutState(args[0], jsonAAsBytes)								
-	if err != nil {
-		return nil, err
-	}
-
-	jsonBAsBytes, _ := json.Marshal(resB)
-	err = stub.PutState(args[1], jsonBAsBytes)								
-	if err != nil {
-		return nil, err
-	}
-	
-	return nil, nil
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sreedhar310/learn-chaincode/builder"
+	"github.com/sreedhar310/learn-chaincode/identity"
+	"errors"
+)
+
+//==============================================================================================================================
+//	Structure Definitions
+//==============================================================================================================================
+//	Chaincode - A blank struct for use with Shim (A HyperLedger included go file used for get/put state
+//				and other HyperLedger functions)
+//==============================================================================================================================
+type  SimpleChaincode struct {
+}		
+
+//==============================================================================================================================
+//	Account - Defines the structure for an account object. JSON on right tells it what JSON fields to map to
+//			  that element when reading a JSON object into the struct e.g. JSON currency -> Struct Currency
+//==============================================================================================================================
+type Account struct{
+	AccountNo string `json:"accountno"`	
+	LegalEntity string `json:"legalentity"`
+	Currency string `json:"currency"`				
+	Balance string `json:"balance"`
+}
+
+var accountIndexStr = "_accountindex"	  // Define an index varibale to track all the accounts stored in the world state
+
+// ============================================================================================================================
+//  Main - main - Starts up the chaincode
+// ============================================================================================================================
+func main() {
+	err := shim.Start(new(SimpleChaincode))
+	if err != nil {
+		fmt.Printf("Error starting Simple chaincode: %s", err)
+	}
+}
+
+// ============================================================================================================================
+// Init Function - Called when the user deploys the chaincode
+// ============================================================================================================================
+func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	var Aval int
+	var err error
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting a single integer")
+	}
+
+	// Initialize the chaincode
+	Aval, err = strconv.Atoi(args[0])
+	if err != nil {
+		return nil, errors.New("Expecting integer value for testing the blockchain network")
+	}
+
+	// Write the state to the ledger, test the network
+	err = stub.PutState("test_key", []byte(strconv.Itoa(Aval)))	
+	if err != nil {
+		return nil, err
+	}
+	
+	var empty []string
+	jsonAsBytes, _ := json.Marshal(empty)								//marshal an emtpy array of strings to clear the account index
+	err = stub.PutState(accountIndexStr, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+	
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Invoke - Called on chaincode invoke. Takes a function name passed and calls that function. Converts some
+//		    initial arguments passed to other things for use in the called function.
+// ============================================================================================================================
+func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+
+	caller, err := identity.Caller(stub)
+	if err != nil {
+		return nil, errors.New("Error retrieving caller information: " + err.Error())
+	}
+
+	// Handle different functions
+	if function == "init" {										//initialize the chaincode state, used as reset
+		return t.Init(stub, "init", args)
+	} else if function == "delete" {									
+		return t.Delete(stub, args)												
+	} else if function == "write" {									
+		return t.Write(stub, args)
+	} else if function == "init_account" {									
+		return t.init_account(stub, caller, args)
+	} else if function == "transfer_balance" {									
+		return t.transfer_balance(stub, caller, args)										
+	}
+	fmt.Errorf("invoke did not find func: " + function)					//error
+
+	return nil, errors.New("Received unknown function invocation: " + function)
+}
+
+// ============================================================================================================================
+//	Query - Called on chaincode query. Takes a function name passed and calls that function. Passes the
+//  		initial arguments passed are passed on to the called function.
+// ============================================================================================================================
+func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+
+	_, err := identity.Caller(stub)
+	if err != nil {
+		return nil, errors.New("Error retrieving caller details: " + err.Error())
+	}
+
+	if function == "read" {												
+		return t.read(stub, args)
+	}
+	fmt.Println("query did not find func: " + function)						//error
+
+	return nil, errors.New("Received unknown function query " + function)
+}
+
+// ============================================================================================================================
+// Read - read a variable from chaincode world state
+// ============================================================================================================================
+func (t *SimpleChaincode) read(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var name, jsonResp string
+	var err error
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting name of the var to query")
+	}
+
+	name = args[0]
+	valAsbytes, err := stub.GetState(name)	
+	if err != nil {
+		jsonResp = "{\"Error\":\"Failed to get state for " + name + "\"}"
+		return nil, errors.New(jsonResp)
+	}
+
+	return valAsbytes, nil												
+}
+
+// ============================================================================================================================
+// Delete - remove a key/value pair from the world state
+// ============================================================================================================================
+func (t *SimpleChaincode) Delete(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+	
+	name := args[0]
+	err := stub.DelState(name)													//remove the key from chaincode state
+	if err != nil {
+		return nil, errors.New("Failed to delete state")
+	}
+
+	//get the account index
+	accountsAsBytes, err := stub.GetState(accountIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get account index")
+	}
+	var accountIndex []string
+	json.Unmarshal(accountsAsBytes, &accountIndex)						
+	
+	//remove account from index
+	for i,val := range accountIndex{
+		if val == name{															//find the correct account
+			accountIndex = append(accountIndex[:i], accountIndex[i+1:]...)			//remove it
+			break
+		}
+	}
+	jsonAsBytes, _ := json.Marshal(accountIndex)									//save the new index
+	err = stub.PutState(accountIndexStr, jsonAsBytes)
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Write - directly write a variable into chaincode world state
+// ============================================================================================================================
+func (t *SimpleChaincode) Write(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var name, value string 
+	var err error
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2. name of the variable and value to set")
+	}
+
+	name = args[0]														
+	value = args[1]
+	err = stub.PutState(name, []byte(value))					
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Init account - create a new account, store into chaincode world state, and then append the account index
+// ============================================================================================================================
+func (t *SimpleChaincode) init_account(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+	var err error
+
+	//       0        1      2
+	// "accountNo", "USD", "3500"
+	// The legal entity is always the caller
+
+	err = identity.CheckArgs(args, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	//input sanitation, build the account from validated fields
+	fmt.Println("- start init acount")
+	f, err := builder.NewAccount().AccountNo(args[0]).LegalEntity(caller).Currency(args[1]).Balance(args[2]).Build()
+	if err != nil {
+		return nil, err
+	}
+	acc := Account{AccountNo: f.AccountNo, LegalEntity: f.LegalEntity, Currency: f.Currency, Balance: f.Balance}
+	accountNo := acc.AccountNo
+
+	//check if account already exists
+	accountAsBytes, err := stub.GetState(accountNo)
+	if err != nil {
+		return nil, errors.New("Failed to get account number")
+	}
+	res := Account{}
+	json.Unmarshal(accountAsBytes, &res)
+	if res.AccountNo == accountNo{
+		return nil, errors.New("This account arleady exists")			
+	}
+	accountAsBytes, err = json.Marshal(acc)
+	if err != nil {
+		return nil, errors.New("Failed to convert the account record")
+	}
+	err = stub.PutState(accountNo, accountAsBytes)							
+	if err != nil {
+		return nil, err
+	}
+		
+	//get the account index
+	accountsAsBytes, err := stub.GetState(accountIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get account index")
+	}
+	var accountIndex []string
+	json.Unmarshal(accountsAsBytes, &accountIndex)							
+	
+	//append the index 
+	accountIndex = append(accountIndex, accountNo)	
+	jsonAsBytes, _ := json.Marshal(accountIndex)
+	err = stub.PutState(accountIndexStr, jsonAsBytes)						
+
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Transfer Balance - Create a transaction between two accounts, transfer a certain amount of balance
+// ============================================================================================================================
+func (t *SimpleChaincode) transfer_balance(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+	
+	//       0           1         2
+	// "accountA", "accountB", "100.20"
+
+	var err error
+	var newAmountA, newAmountB float64
+
+	err = identity.CheckArgs(args, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	amount,err := strconv.ParseFloat(args[2], 64)
+	if err != nil {
+		return nil, errors.New("3rd argument must be a numeric string")
+	}
+
+	accountAAsBytes, err := stub.GetState(args[0])
+	if err != nil {
+		return nil, errors.New("Failed to get the first account")
+	}
+	resA := Account{}
+	json.Unmarshal(accountAAsBytes, &resA)								
+	if resA.AccountNo != args[0] {
+		return nil, errors.New("Account " + args[0] + " does not exist")
+	}
+	if resA.LegalEntity != strings.ToLower(caller) {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. transfer_balance. %v !== %v", caller, resA.LegalEntity))
+	}
+	
+	accountBAsBytes, err := stub.GetState(args[1])
+	if err != nil {
+		return nil, errors.New("Failed to get the second account")
+	}
+	resB := Account{}
+	json.Unmarshal(accountBAsBytes, &resB)											
+	if resB.AccountNo != args[1] {
+		return nil, errors.New("Account " + args[1] + " does not exist")
+	}
+	
+	BalanceA,err := strconv.ParseFloat(resA.Balance, 64)
+	if err != nil {
+		return nil, err
+	}
+	BalanceB,err := strconv.ParseFloat(resB.Balance, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	//Check if accountA has enough balance to transact or not
+	if (BalanceA - amount) < 0 {
+		return nil, errors.New(args[0] + " doesn't have enough balance to complete transaction")
+	}
+
+	newAmountA = BalanceA - amount
+	newAmountB =  BalanceB + amount
+	newAmountStrA := strconv.FormatFloat(newAmountA, 'E', -1, 64)
+	newAmountStrB := strconv.FormatFloat(newAmountB, 'E', -1, 64)
+
+	resA.Balance = newAmountStrA
+	resB.Balance = newAmountStrB
+
+	jsonAAsBytes, _ := json.Marshal(resA)
+	err = stub.PutState(args[0], jsonAAsBytes)								
+	if err != nil {
+		return nil, err
+	}
+
+	jsonBAsBytes, _ := json.Marshal(resB)
+	err = stub.PutState(args[1], jsonBAsBytes)								
+	if err != nil {
+		return nil, err
+	}
+	
+	return nil, nil
 }
\ No newline at end of file
@@ -0,0 +1,206 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// Package builder builds new invoice and account records field by field for the
+// invoice and account chaincodes. Each setter validates its value and the first
+// failure is kept and returned by Build, so a quote or brace in an argument can
+// never reach the stored JSON. The chaincodes copy the built fields into their
+// own record types.
+package builder
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sreedhar310/learn-chaincode/validate"
+)
+
+// Undefined is the value of optional invoice fields that haven't been set
+const Undefined = "UNDEFINED"
+
+// InvoiceFields are the fields of a new invoice
+type InvoiceFields struct {
+	InvoiceId string
+	Amount    string
+	Currency  string
+	Discount  string
+	DueDate   string
+	Supplier  string
+	Payer     string
+}
+
+// Invoice builds the fields of a new invoice
+type Invoice struct {
+	fields InvoiceFields
+	err    error
+}
+
+// NewInvoice starts an invoice in USD with no due date or discount
+func NewInvoice() *Invoice {
+	return &Invoice{fields: InvoiceFields{Currency: "USD", DueDate: Undefined, Discount: Undefined}}
+}
+
+func (b *Invoice) fail(field string, err error) *Invoice {
+	if b.err == nil && err != nil {
+		b.err = errors.New("Invalid " + field + ": " + err.Error())
+	}
+	return b
+}
+
+// ID sets the invoice ID
+func (b *Invoice) ID(id string) *Invoice {
+	b.fields.InvoiceId = id
+	return b.fail("invoiceid", validate.ID(id))
+}
+
+// Amount sets the invoice amount, which can't have fractions of a cent
+func (b *Invoice) Amount(amount string) *Invoice {
+	n, err := validate.Money(amount)
+	b.fields.Amount = strconv.FormatFloat(n, 'f', 2, 64)
+	return b.fail("amount", err)
+}
+
+// Currency sets the invoice currency
+func (b *Invoice) Currency(currency string) *Invoice {
+	b.fields.Currency = currency
+	return b.fail("currency", validate.Currency(currency))
+}
+
+// Discount sets the discount rate a buyer gets
+func (b *Invoice) Discount(discount string) *Invoice {
+	_, err := validate.Rate(discount)
+	b.fields.Discount = discount
+	return b.fail("discount", err)
+}
+
+// DueDate sets the due date, as YYYY-MM-DD
+func (b *Invoice) DueDate(date string) *Invoice {
+	_, err := time.Parse("2006-01-02", date)
+	b.fields.DueDate = date
+	return b.fail("duedate", err)
+}
+
+// Supplier sets the supplier
+func (b *Invoice) Supplier(name string) *Invoice {
+	b.fields.Supplier = name
+	return b.fail("supplier", validate.Name(name))
+}
+
+// Payer sets the payer
+func (b *Invoice) Payer(name string) *Invoice {
+	b.fields.Payer = name
+	return b.fail("payer", validate.Name(name))
+}
+
+// Payload fills the invoice from a JSON payload checked against the published invoice schema
+func (b *Invoice) Payload(payload string) *Invoice {
+	fields, err := validate.Payload(payload, validate.InvoiceSchema)
+	if err != nil {
+		return b.fail("payload", err)
+	}
+
+	b.ID(fields["invoiceid"]).Amount(fields["amount"]).Payer(fields["payer"])
+
+	if val, ok := fields["supplier"]; ok {
+		b.Supplier(val)
+	}
+	if val, ok := fields["currency"]; ok {
+		b.Currency(val)
+	}
+	if val, ok := fields["duedate"]; ok {
+		b.DueDate(val)
+	}
+	if val, ok := fields["discount"]; ok {
+		b.Discount(val)
+	}
+	return b
+}
+
+// Fields returns the fields set so far, valid or not
+func (b *Invoice) Fields() InvoiceFields {
+	return b.fields
+}
+
+// Build returns the fields once every one is valid and both the supplier and the payer have been set
+func (b *Invoice) Build() (InvoiceFields, error) {
+	b.Supplier(b.fields.Supplier).Payer(b.fields.Payer)
+	return b.fields, b.err
+}
+
+// AccountFields are the fields of a new account
+type AccountFields struct {
+	AccountNo   string
+	LegalEntity string
+	Currency    string
+	Balance     string
+}
+
+// Account builds the fields of a new account
+type Account struct {
+	fields AccountFields
+	err    error
+}
+
+// NewAccount starts an empty account
+func NewAccount() *Account {
+	return &Account{}
+}
+
+func (b *Account) fail(field string, err error) *Account {
+	if b.err == nil && err != nil {
+		b.err = errors.New("Invalid " + field + ": " + err.Error())
+	}
+	return b
+}
+
+// AccountNo sets the account number
+func (b *Account) AccountNo(accountNo string) *Account {
+	b.fields.AccountNo = accountNo
+	return b.fail("account number", validate.ID(accountNo))
+}
+
+// LegalEntity sets the legal entity owning the account, which is compared in lower case
+func (b *Account) LegalEntity(name string) *Account {
+	b.fields.LegalEntity = strings.ToLower(name)
+	return b.fail("legal entity", validate.Name(name))
+}
+
+// Currency sets the account currency
+func (b *Account) Currency(currency string) *Account {
+	b.fields.Currency = currency
+	return b.fail("currency", validate.Currency(currency))
+}
+
+// Balance sets the opening balance
+func (b *Account) Balance(balance string) *Account {
+	amount, err := validate.Balance(balance)
+	b.fields.Balance = strconv.FormatFloat(amount, 'E', -1, 64)
+	return b.fail("balance", err)
+}
+
+// Build returns the fields once every one has been set and is valid
+func (b *Account) Build() (AccountFields, error) {
+	f := b.fields
+	if b.err == nil && (f.AccountNo == "" || f.LegalEntity == "" || f.Currency == "" || f.Balance == "") {
+		b.err = errors.New("Account is missing a field")
+	}
+	return f, b.err
+}
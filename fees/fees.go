@@ -0,0 +1,287 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// Package fees keeps the fee schedule a chaincode charges for its operations,
+// the accounts fees are paid into, and the totals collected. A rule is set per
+// operation and currency: a flat fee plus a percentage of the amount, kept
+// between a minimum and a maximum. Operations without a rule are free. Moving
+// the money is left to the chaincode, which knows its own accounts, and it
+// reports each fee back with Collected.
+package fees
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sreedhar310/learn-chaincode/validate"
+)
+
+// Keys contain ':', which account numbers and invoice IDs can't, so they never clash with other records
+const (
+	scheduleKey = "fees:schedule"
+	totalsKey   = "fees:totals"
+)
+
+// Rule is the fee for one operation in one currency. Percent is a fraction of
+// the amount, so 0.01 is one percent, and a Max of zero means no maximum.
+type Rule struct {
+	Operation string  `json:"operation"`
+	Currency  string  `json:"currency"`
+	Flat      float64 `json:"flat"`
+	Percent   float64 `json:"percent"`
+	Min       float64 `json:"min"`
+	Max       float64 `json:"max"`
+}
+
+// Schedule is every rule, and the account fees are paid into for each currency
+type Schedule struct {
+	Rules    []Rule            `json:"rules"`
+	Accounts map[string]string `json:"accounts"`
+}
+
+// Total is what has been collected for one operation in one currency
+type Total struct {
+	Operation string  `json:"operation"`
+	Currency  string  `json:"currency"`
+	Count     int     `json:"count"`
+	Collected float64 `json:"collected"`
+}
+
+// Report is the totals by operation and currency, and by currency alone
+type Report struct {
+	Totals     []Total            `json:"totals"`
+	ByCurrency map[string]float64 `json:"bycurrency"`
+}
+
+// ParseRule builds a rule from the arguments operation, currency, flat, percent, min and max.
+// The operation must be one of operations, the ones the chaincode charges fees on, so a
+// misspelt rule is refused rather than never being charged.
+func ParseRule(args []string, operations []string) (Rule, error) {
+	var rule Rule
+	if len(args) != 6 {
+		return rule, errors.New("Incorrect number of arguments. Expecting operation, currency, flat, percent, min and max")
+	}
+	known := false
+	for _, operation := range operations {
+		if args[0] == operation {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return rule, fmt.Errorf("No fee can be charged on %s. Fees apply to %v", args[0], operations)
+	}
+	if err := validate.Currency(args[1]); err != nil {
+		return rule, errors.New("Invalid currency: " + err.Error())
+	}
+
+	var err error
+	rule = Rule{Operation: args[0], Currency: args[1]}
+	if rule.Flat, err = validate.Balance(args[2]); err != nil {
+		return rule, errors.New("Invalid flat fee: " + err.Error())
+	}
+	if rule.Percent, err = validate.Rate(args[3]); err != nil {
+		return rule, errors.New("Invalid percentage: " + err.Error())
+	}
+	if rule.Min, err = validate.Balance(args[4]); err != nil {
+		return rule, errors.New("Invalid minimum fee: " + err.Error())
+	}
+	if rule.Max, err = validate.Balance(args[5]); err != nil {
+		return rule, errors.New("Invalid maximum fee: " + err.Error())
+	}
+	if rule.Max > 0 && rule.Max < rule.Min {
+		return rule, errors.New("The maximum fee can't be less than the minimum")
+	}
+	return rule, nil
+}
+
+// Fee works out the fee a rule charges on an amount
+func (r Rule) Fee(amount float64) float64 {
+	fee := r.Flat + amount*r.Percent
+	if fee < r.Min {
+		fee = r.Min
+	}
+	if r.Max > 0 && fee > r.Max {
+		fee = r.Max
+	}
+	return fee
+}
+
+// GetSchedule returns the fee schedule, empty if none has been set
+func GetSchedule(stub shim.ChaincodeStubInterface) (Schedule, error) {
+	schedule := Schedule{Accounts: map[string]string{}}
+
+	bytes, err := stub.GetState(scheduleKey)
+	if err != nil {
+		return schedule, errors.New("Failed to get the fee schedule")
+	}
+	if bytes == nil {
+		return schedule, nil
+	}
+	if err = json.Unmarshal(bytes, &schedule); err != nil {
+		return schedule, errors.New("Corrupt fee schedule")
+	}
+	if schedule.Accounts == nil {
+		schedule.Accounts = map[string]string{}
+	}
+	return schedule, nil
+}
+
+func putSchedule(stub shim.ChaincodeStubInterface, schedule Schedule) error {
+	bytes, err := json.Marshal(schedule)
+	if err != nil {
+		return errors.New("Error converting the fee schedule")
+	}
+	return stub.PutState(scheduleKey, bytes)
+}
+
+// SetRule adds a rule, replacing any rule for the same operation and currency
+func SetRule(stub shim.ChaincodeStubInterface, rule Rule) error {
+	schedule, err := GetSchedule(stub)
+	if err != nil {
+		return err
+	}
+	for i, r := range schedule.Rules {
+		if r.Operation == rule.Operation && r.Currency == rule.Currency {
+			schedule.Rules[i] = rule
+			return putSchedule(stub, schedule)
+		}
+	}
+	schedule.Rules = append(schedule.Rules, rule)
+	return putSchedule(stub, schedule)
+}
+
+// RemoveRule makes an operation free again in a currency
+func RemoveRule(stub shim.ChaincodeStubInterface, operation string, currency string) error {
+	schedule, err := GetSchedule(stub)
+	if err != nil {
+		return err
+	}
+	for i, r := range schedule.Rules {
+		if r.Operation == operation && r.Currency == currency {
+			schedule.Rules = append(schedule.Rules[:i], schedule.Rules[i+1:]...)
+			return putSchedule(stub, schedule)
+		}
+	}
+	return fmt.Errorf("No fee rule for %v in %v", operation, currency)
+}
+
+// SetAccount designates the account fees in a currency are paid into
+func SetAccount(stub shim.ChaincodeStubInterface, currency string, account string) error {
+	schedule, err := GetSchedule(stub)
+	if err != nil {
+		return err
+	}
+	schedule.Accounts[currency] = account
+	return putSchedule(stub, schedule)
+}
+
+// Quote returns the fee for an operation on an amount, rounded to the cent,
+// and the account it is paid into. A fee of zero means the operation is free. A fee without an
+// account to pay it into is an error, rather than a fee silently not charged.
+func Quote(stub shim.ChaincodeStubInterface, operation string, currency string, amount float64) (float64, string, error) {
+	schedule, err := GetSchedule(stub)
+	if err != nil {
+		return 0, "", err
+	}
+	for _, r := range schedule.Rules {
+		if r.Operation != operation || r.Currency != currency {
+			continue
+		}
+		fee := math.Floor(r.Fee(amount)*100+0.5) / 100
+		if fee <= 0 {
+			return 0, "", nil
+		}
+		account, ok := schedule.Accounts[currency]
+		if !ok || account == "" {
+			return 0, "", fmt.Errorf("%v is charged a fee in %v but there is no fee account for %v", operation, currency, currency)
+		}
+		return fee, account, nil
+	}
+	return 0, "", nil
+}
+
+// Collected adds a fee to the totals
+func Collected(stub shim.ChaincodeStubInterface, operation string, currency string, fee float64) error {
+	var totals []Total
+
+	bytes, err := stub.GetState(totalsKey)
+	if err != nil {
+		return errors.New("Failed to get fee totals")
+	}
+	if bytes != nil {
+		if err = json.Unmarshal(bytes, &totals); err != nil {
+			return errors.New("Corrupt fee totals")
+		}
+	}
+
+	found := false
+	for i := range totals {
+		if totals[i].Operation == operation && totals[i].Currency == currency {
+			totals[i].Count++
+			totals[i].Collected += fee
+			found = true
+		}
+	}
+	if !found {
+		totals = append(totals, Total{Operation: operation, Currency: currency, Count: 1, Collected: fee})
+	}
+
+	bytes, err = json.Marshal(totals)
+	if err != nil {
+		return errors.New("Error converting fee totals")
+	}
+	return stub.PutState(totalsKey, bytes)
+}
+
+type byOperation []Total
+
+func (b byOperation) Len() int      { return len(b) }
+func (b byOperation) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byOperation) Less(i, j int) bool {
+	if b[i].Operation != b[j].Operation {
+		return b[i].Operation < b[j].Operation
+	}
+	return b[i].Currency < b[j].Currency
+}
+
+// GetReport returns the fee totals as JSON, for a query to pass straight back
+func GetReport(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	report := Report{Totals: []Total{}, ByCurrency: map[string]float64{}}
+
+	bytes, err := stub.GetState(totalsKey)
+	if err != nil {
+		return nil, errors.New("Failed to get fee totals")
+	}
+	if bytes != nil {
+		if err = json.Unmarshal(bytes, &report.Totals); err != nil {
+			return nil, errors.New("Corrupt fee totals")
+		}
+	}
+
+	sort.Sort(byOperation(report.Totals))
+	for _, total := range report.Totals {
+		report.ByCurrency[total.Currency] += total.Collected
+	}
+	return json.Marshal(report)
+}
@@ -20,10 +20,26 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sreedhar310/learn-chaincode/idempotency"
+	"github.com/sreedhar310/learn-chaincode/identity"
+	"github.com/sreedhar310/learn-chaincode/validate"
 )
 
+// Balances are stored under the user's name, so the chaincode's own keys start with '_' and user names can't
+const issuerKey = "_issuer"
+const totalSupplyKey = "_totalsupply"
+
+// testKey holds the value Init is deployed with, which isn't a balance, so no user can be called that either
+const testKey = "test_key"
+
+// reserved - true for the names of the chaincode's own keys, which can't hold a balance
+func reserved(name string) bool {
+	return name == testKey || strings.HasPrefix(name, "_")
+}
+
 // SimpleChaincode example simple Chaincode implementation
 type SimpleChaincode struct {
 }
@@ -35,17 +51,28 @@ func main() {
 	}
 }
 
-// Init resets all the things
+// Init resets all the things. The optional second argument names the issuer, the only user who can mint and burn.
 func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1, and optionally the issuer")
 	}
 
-	err := stub.PutState("test_key", []byte(args[0]))
+	err := stub.PutState(testKey, []byte(args[0]))
 	if err != nil {
 		return nil, err
 	}
 
+	if len(args) == 2 {
+		err = validate.Name(args[1])
+		if err != nil {
+			return nil, errors.New("Invalid issuer: " + err.Error())
+		}
+		err = stub.PutState(issuerKey, []byte(args[1]))
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return nil, nil
 }
 
@@ -55,15 +82,36 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function stri
 
 	// Handle different functions
 	if function == "init" {
+		if err := t.check_issuer(stub, function); err != nil {
+			return nil, err
+		}
 		return t.Init(stub, "init", args)
-	} else if function == "write" {
+	} else if function == "write" { //write and delete can set any balance, so only the issuer may use them
+		if err := t.check_issuer(stub, function); err != nil {
+			return nil, err
+		}
 		return t.write(stub, args)
 	} else if function == "delete" {
+		if err := t.check_issuer(stub, function); err != nil {
+			return nil, err
+		}
 		return t.delete(stub, args)
-	} else if function == "init_amount" {
-		return t.init_amount(stub, args)
+	} else if function == "mint" {
+		if err := t.check_issuer(stub, function); err != nil {
+			return nil, err
+		}
+		return t.mint(stub, args)
+	} else if function == "burn" {
+		if err := t.check_issuer(stub, function); err != nil {
+			return nil, err
+		}
+		return t.burn(stub, args)
 	} else if function == "transfer" {
-		return t.transfer(stub, args)
+		caller, err := identity.Caller(stub)
+		if err != nil {
+			return nil, errors.New("Error retrieving caller information: " + err.Error())
+		}
+		return idempotency.Run(stub, caller, function, args, func() ([]byte, error) { return t.transfer(stub, args) })
 	}
 	fmt.Println("invoke did not find func: " + function)
 
@@ -77,6 +125,8 @@ func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function strin
 	// Handle different functions
 	if function == "read" { //read a variable
 		return t.read(stub, args)
+	} else if function == "get_total_supply" {
+		return t.get_total_supply(stub)
 	}
 	fmt.Println("query did not find func: " + function)
 
@@ -139,47 +189,109 @@ func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string
 }
 
 // ============================================================================================================================
-// Init Amount - set the initial amount for user
+// check_issuer - fail unless the caller is the issuer named at deploy
 // ============================================================================================================================
-func (t *SimpleChaincode) init_amount(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var err error
+func (t *SimpleChaincode) check_issuer(stub shim.ChaincodeStubInterface, function string) error {
+	caller, err := identity.Caller(stub)
+	if err != nil {
+		return errors.New("Error retrieving caller information: " + err.Error())
+	}
+	issuer, err := stub.GetState(issuerKey)
+	if err != nil {
+		return errors.New("Failed to get the issuer")
+	}
+	if issuer == nil || !strings.EqualFold(string(issuer), caller) {
+		return errors.New(fmt.Sprintf("Permission Denied. %v. %v is not the issuer", function, caller))
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// balance_of - a user's balance, zero for a user who has never held any
+// ============================================================================================================================
+func (t *SimpleChaincode) balance_of(stub shim.ChaincodeStubInterface, key string) (float64, error) {
+	amountBytes, err := stub.GetState(key)
+	if err != nil {
+		return 0, errors.New("{\"Error\":\"Failed to get state for " + key + "\"}")
+	}
+	if amountBytes == nil {
+		return 0, nil
+	}
+	return strconv.ParseFloat(string(amountBytes), 64)
+}
+
+// ============================================================================================================================
+// Mint and burn - the only ways money enters or leaves circulation. Each moves a user's balance and the total supply
+// together, so the balances always add up to the supply.
+// ============================================================================================================================
+func (t *SimpleChaincode) mint(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	return t.issue(stub, args, 1)
+}
+
+func (t *SimpleChaincode) burn(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	return t.issue(stub, args, -1)
+}
+
+func (t *SimpleChaincode) issue(stub shim.ChaincodeStubInterface, args []string, sign float64) ([]byte, error) {
 
-	//   0      1 
+	//   0      1
 	// "bob", "200.45"
 	if len(args) != 2 {
 		return nil, errors.New("Incorrect number of arguments. Expecting 2")
 	}
 
-	//input sanitation
-	fmt.Println("- start init amount")
-	if len(args[0]) <= 0 {
-		return nil, errors.New("1st argument must be a non-empty string")
+	name := args[0]
+	if err := validate.Name(name); err != nil {
+		return nil, errors.New("Invalid user: " + err.Error())
 	}
-	if len(args[1]) <= 0 {
-		return nil, errors.New("2nd argument must be a non-empty string")
+	if reserved(name) {
+		return nil, errors.New("User names can't start with '_' or be " + testKey)
 	}
-	
-	name := args[0]
-	amount,err := strconv.ParseFloat(args[1], 64)
+	amount, err := validate.Money(args[1])
 	if err != nil {
-		return nil, errors.New("2nd argument must be a numeric string")
+		return nil, errors.New("2nd argument must be a positive amount with at most two decimal places")
+	}
+
+	balance, err := t.balance_of(stub, name)
+	if err != nil {
+		return nil, err
 	}
-	amountStr := strconv.FormatFloat(amount, 'E', -1, 64)
-	err = stub.PutState(name, []byte(amountStr))									//store marble with id as key
+	supply, err := t.balance_of(stub, totalSupplyKey)
 	if err != nil {
 		return nil, err
 	}
+	if sign < 0 && amount > balance {
+		return nil, errors.New(name + " doesn't have enough balance to burn")
+	}
 
-	fmt.Println("- end init amount")
+	err = stub.PutState(name, []byte(strconv.FormatFloat(balance+sign*amount, 'E', -1, 64)))
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(totalSupplyKey, []byte(strconv.FormatFloat(supply+sign*amount, 'E', -1, 64)))
+	if err != nil {
+		return nil, err
+	}
 	return nil, nil
 }
 
+// ============================================================================================================================
+// Get total supply - everything minted less everything burnt
+// ============================================================================================================================
+func (t *SimpleChaincode) get_total_supply(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	supply, err := t.balance_of(stub, totalSupplyKey)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strconv.FormatFloat(supply, 'E', -1, 64)), nil
+}
+
 // ============================================================================================================================
 // Transfer money from user A to user B
 // ============================================================================================================================
 func (t *SimpleChaincode) transfer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	var err error
-	var userA, userB, jsonResp string
+	var userA, userB string
 	var newAmountA, newAmountB float64
 	
 	//    0       1      2
@@ -193,27 +305,24 @@ func (t *SimpleChaincode) transfer(stub shim.ChaincodeStubInterface, args []stri
 
 	userA = args[0]
 	userB = args[1]
-	amount,err := strconv.ParseFloat(args[2], 64)
-	if err != nil {
-		return nil, errors.New("3rd argument must be a numeric string")
+	if reserved(userA) || reserved(userB) {
+		return nil, errors.New("Can't transfer to or from the chaincode's own keys")
 	}
-	amountByteA, err := stub.GetState(userA)
-	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + userA + "\"}"
-		return nil, errors.New(jsonResp)
-	}	
-	amountByteB, err := stub.GetState(userB)	
+	if userA == userB {
+		return nil, errors.New("Can't transfer from a user to themselves")
+	}
+	if err = validate.Name(userB); err != nil {
+		return nil, errors.New("Invalid user: " + err.Error())
+	}
+	amount, err := validate.Money(args[2])
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + userB + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, errors.New("3rd argument must be a positive amount with at most two decimal places")
 	}
-	amountStrA := string(amountByteA[:])
-	amountStrB := string(amountByteB[:])
-	amountA,err := strconv.ParseFloat(amountStrA, 64)
+	amountA, err := t.balance_of(stub, userA)
 	if err != nil {
 		return nil, err
 	}
-	amountB,err := strconv.ParseFloat(amountStrB, 64)
+	amountB, err := t.balance_of(stub, userB)
 	if err != nil {
 		return nil, err
 	}
@@ -227,13 +336,13 @@ func (t *SimpleChaincode) transfer(stub shim.ChaincodeStubInterface, args []stri
 	newAmountStrB := strconv.FormatFloat(newAmountB, 'E', -1, 64)
 
 
-	err = stub.PutState(args[0], []byte(newAmountStrA))		
+	err = stub.PutState(userA, []byte(newAmountStrA))		
 
 	if err != nil {
 		return nil, err
 	}
 
-	err = stub.PutState(args[1], []byte(newAmountStrB))		
+	err = stub.PutState(userB, []byte(newAmountStrB))		
 
 	if err != nil {
 		return nil, err
@@ -241,4 +350,4 @@ func (t *SimpleChaincode) transfer(stub shim.ChaincodeStubInterface, args []stri
 	
 	fmt.Println("- transfer completed")
 	return nil, nil
-}
\ No newline at end of file
+}
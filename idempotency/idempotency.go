@@ -0,0 +1,134 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// Package idempotency lets a client resubmit an invoke without applying it
+// twice. The client puts a key of its choosing in the transaction metadata as
+// {"idempotencykey":"<key>"}. The first transaction with that key runs and its
+// result is stored on the ledger; a replay with the same function and
+// arguments returns the stored result without running again, and a replay
+// with anything different is refused.
+package idempotency
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// MaxKeyLength is the longest idempotency key accepted
+const MaxKeyLength = 128
+
+// keyPrefix contains ':', which account numbers and invoice IDs can't, so records never clash with them
+const keyPrefix = "idem:"
+
+// Record is what is stored for a key
+type Record struct {
+	Key         string `json:"key"`
+	Caller      string `json:"caller"`
+	Function    string `json:"function"`
+	Fingerprint string `json:"fingerprint"`
+	TxId        string `json:"txid"`
+	Result      []byte `json:"result"`
+}
+
+type metadata struct {
+	IdempotencyKey string `json:"idempotencykey"`
+}
+
+// Key returns the idempotency key from the transaction metadata, or "" if there isn't one
+func Key(stub shim.ChaincodeStubInterface) (string, error) {
+	raw, err := stub.GetCallerMetadata()
+	if err != nil {
+		return "", errors.New("Couldn't read transaction metadata. Error: " + err.Error())
+	}
+	if len(raw) == 0 {
+		return "", nil
+	}
+
+	var m metadata
+	if err = json.Unmarshal(raw, &m); err != nil {
+		return "", errors.New("Transaction metadata is not valid JSON")
+	}
+	if len(m.IdempotencyKey) > MaxKeyLength {
+		return "", fmt.Errorf("Idempotency key can't be longer than %d characters", MaxKeyLength)
+	}
+	return m.IdempotencyKey, nil
+}
+
+// stateKey is where a caller's key is recorded. Caller names may contain ':', so the caller is prefixed with its
+// length; otherwise caller "a:b" with key "c" and caller "a" with key "b:c" would share a record.
+func stateKey(caller string, key string) string {
+	return keyPrefix + strconv.Itoa(len(caller)) + ":" + caller + ":" + key
+}
+
+// fingerprint identifies a call by its function and arguments
+func fingerprint(function string, args []string) string {
+	bytes, _ := json.Marshal(append([]string{function}, args...))
+	sum := sha256.Sum256(bytes)
+	return hex.EncodeToString(sum[:])
+}
+
+// Run calls fn unless the caller has already used the transaction's idempotency key. Keys belong to the caller, so
+// two callers can't collide or read each other's results. Without a key fn is simply called.
+func Run(stub shim.ChaincodeStubInterface, caller string, function string, args []string, fn func() ([]byte, error)) ([]byte, error) {
+	key, err := Key(stub)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return fn()
+	}
+
+	recordKey := stateKey(caller, key)
+	fp := fingerprint(function, args)
+
+	bytes, err := stub.GetState(recordKey)
+	if err != nil {
+		return nil, errors.New("Failed to get idempotency record for " + key)
+	}
+	if bytes != nil {
+		var rec Record
+		if err = json.Unmarshal(bytes, &rec); err != nil {
+			return nil, errors.New("Corrupt idempotency record for " + key)
+		}
+		if rec.Function != function || rec.Fingerprint != fp {
+			return nil, fmt.Errorf("Idempotency key %v was already used by transaction %v with different parameters", key, rec.TxId)
+		}
+		return rec.Result, nil
+	}
+
+	result, err := fn()
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err = json.Marshal(Record{Key: key, Caller: caller, Function: function, Fingerprint: fp, TxId: stub.GetTxID(), Result: result})
+	if err != nil {
+		return nil, errors.New("Failed to convert idempotency record for " + key)
+	}
+	if err = stub.PutState(recordKey, bytes); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
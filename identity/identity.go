@@ -0,0 +1,61 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// Package identity works out who is invoking a chaincode. The caller is always
+// read from the transaction certificate, never from the arguments, and any
+// failure to read it is an error rather than an anonymous caller.
+package identity
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sreedhar310/learn-chaincode/validate"
+)
+
+// UsernameAttribute is the transaction certificate attribute holding the caller's username
+const UsernameAttribute = "username"
+
+// Caller returns the username from the caller's transaction certificate. It fails if the attribute
+// can't be read, is empty or isn't a valid participant name.
+func Caller(stub shim.ChaincodeStubInterface) (string, error) {
+	username, err := stub.ReadCertAttribute(UsernameAttribute)
+	if err != nil {
+		return "", errors.New("Couldn't get attribute '" + UsernameAttribute + "'. Error: " + err.Error())
+	}
+
+	if err = validate.Name(string(username)); err != nil {
+		return "", errors.New("Invalid attribute '" + UsernameAttribute + "': " + err.Error())
+	}
+
+	return string(username), nil
+}
+
+// CheckArgs fails unless exactly n arguments were passed. One argument too many is how clients that
+// still pass the acting user show up, so that case gets its own error instead of being ignored.
+func CheckArgs(args []string, n int) error {
+	if len(args) == n {
+		return nil
+	}
+	if len(args) == n+1 {
+		return fmt.Errorf("Incorrect number of arguments. Expecting %d. The caller is taken from the transaction certificate and can't be passed as an argument", n)
+	}
+	return fmt.Errorf("Incorrect number of arguments. Expecting %d", n)
+}
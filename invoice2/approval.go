@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sreedhar310/learn-chaincode/identity"
+)
+
+//==============================================================================================================================
+//	Approval Policy - Defines who may confirm invoices on behalf of a payer. The rule with the highest MinAmount not
+//					  above the invoice amount applies, e.g. 1 of 4 signatories below 10000.00 and 2 of 4 from there up.
+//					  A payer without a policy approves on its own, as before.
+//==============================================================================================================================
+type Approval_Rule struct {
+	MinAmount        string   `json:"minamount"`
+	Required         int      `json:"required"`
+	Signatories      []string `json:"signatories"`
+}
+
+type Approval_Policy struct {
+	Payer            string          `json:"payer"`
+	Rules            []Approval_Rule `json:"rules"`
+}
+
+//==============================================================================================================================
+//	 Actions a payer's signatories approve
+//==============================================================================================================================
+
+const   APPROVE_TRADE    =  "trade"			// Subject is the buyer whose trade is being approved
+const   APPROVE_PROGRAM  =  "program"		// Subject is the program the invoice is being approved for
+
+//==============================================================================================================================
+//	Approvals - The signatories who have approved one action on an invoice so far. Approvals for different actions, or
+//				for the same action with a different buyer or program, are kept apart and never add up.
+//==============================================================================================================================
+type Approvals struct {
+	InvoiceId        string   `json:"invoiceid"`
+	Action           string   `json:"action"`
+	Subject          string   `json:"subject"`
+	Required         int      `json:"required"`
+	Signatories      []string `json:"signatories"`
+}
+
+func policy_key(payer string) string { return "policy:" + payer }
+func approvals_key(invoiceId string, action string, subject string) string { return "approvals:" + invoiceId + ":" + action + ":" + subject }
+
+//==============================================================================================================================
+//	 retrieve_policy - Returns the payer's policy, or nil if the payer hasn't registered one
+//==============================================================================================================================
+func (t *SimpleChaincode) retrieve_policy(stub shim.ChaincodeStubInterface, payer string) (*Approval_Policy, error) {
+
+	bytes, err := stub.GetState(policy_key(payer))
+	if err != nil { return nil, errors.New("RETRIEVE_POLICY: Error retrieving approval policy for " + payer) }
+	if bytes == nil { return nil, nil }
+
+	var policy Approval_Policy
+
+	err = json.Unmarshal(bytes, &policy)
+	if err != nil { return nil, errors.New("RETRIEVE_POLICY: Corrupt approval policy record " + string(bytes)) }
+
+	return &policy, nil
+}
+
+//==============================================================================================================================
+//	 applicable_rule - Picks the policy rule for an invoice's amount
+//==============================================================================================================================
+func applicable_rule(policy *Approval_Policy, inv Invoice) (Approval_Rule, error) {
+
+	var rule Approval_Rule
+
+	amount, err := strconv.ParseFloat(inv.Amount, 64)
+	if err != nil { return rule, errors.New("Invoice amount is not numeric: " + inv.Amount) }
+
+	found := false
+	best := 0.0
+
+	for _, r := range policy.Rules {
+		min, err := strconv.ParseFloat(r.MinAmount, 64)
+		if err != nil { return rule, errors.New("Approval rule amount is not numeric: " + r.MinAmount) }
+
+		if min <= amount && (!found || min > best) {
+			rule, best, found = r, min, true
+		}
+	}
+
+	if !found { return rule, errors.New(fmt.Sprintf("No approval rule for %v covers amount %v", policy.Payer, inv.Amount)) }
+
+	return rule, nil
+}
+
+//==============================================================================================================================
+//	 is_payer_signatory - Checks the caller may act for the invoice's payer, either as the payer itself when there is no
+//						  policy or as one of the signatories of the applicable rule
+//==============================================================================================================================
+func (t *SimpleChaincode) is_payer_signatory(stub shim.ChaincodeStubInterface, inv Invoice, caller string) (bool, error) {
+
+	policy, err := t.retrieve_policy(stub, inv.Payer)
+	if err != nil { return false, err }
+
+	if policy == nil { return caller == inv.Payer, nil }
+
+	rule, err := applicable_rule(policy, inv)
+	if err != nil { return false, err }
+
+	return contains(rule.Signatories, caller), nil
+}
+
+//==============================================================================================================================
+//	 record_approval - Adds the caller's approval of an action on the invoice and reports whether the payer's policy is
+//					   now satisfied, in which case the approvals are cleared. Only approvals from signatories of the
+//					   rule as it stands now count, so a signatory removed from the policy no longer helps reach it.
+//==============================================================================================================================
+func (t *SimpleChaincode) record_approval(stub shim.ChaincodeStubInterface, inv Invoice, caller string, function string, action string, subject string) (bool, error) {
+
+	policy, err := t.retrieve_policy(stub, inv.Payer)
+	if err != nil { return false, err }
+
+	if policy == nil {
+		if caller != inv.Payer {
+			return false, errors.New(fmt.Sprintf("Permission Denied. %v. %v !== %v", function, caller, inv.Payer))
+		}
+		return true, nil
+	}
+
+	rule, err := applicable_rule(policy, inv)
+	if err != nil { return false, err }
+
+	if !contains(rule.Signatories, caller) {
+		return false, errors.New(fmt.Sprintf("Permission Denied. %v. %v is not a signatory for %v", function, caller, inv.Payer))
+	}
+
+	key := approvals_key(inv.InvoiceId, action, subject)
+
+	approvals := Approvals{InvoiceId: inv.InvoiceId, Action: action, Subject: subject, Signatories: []string{}}
+
+	bytes, err := stub.GetState(key)
+	if err != nil { return false, errors.New("Unable to get approvals for invoice " + inv.InvoiceId) }
+
+	if bytes != nil {
+		err = json.Unmarshal(bytes, &approvals)
+		if err != nil { return false, errors.New("Corrupt Approvals record") }
+	}
+
+	if contains(approvals.Signatories, caller) {
+		return false, errors.New(fmt.Sprintf("%v has already approved invoice %v", caller, inv.InvoiceId))
+	}
+
+	current := []string{}
+	for _, name := range approvals.Signatories {
+		if contains(rule.Signatories, name) { current = append(current, name) }
+	}
+
+	approvals.Required = rule.Required
+	approvals.Signatories = append(current, caller)
+
+	if len(approvals.Signatories) >= rule.Required {
+		return true, t.clear_approvals(stub, inv.InvoiceId, action, subject)
+	}
+
+	bytes, err = json.Marshal(approvals)
+	if err != nil { return false, errors.New("Error converting approvals record") }
+
+	err = stub.PutState(key, bytes)
+	if err != nil { return false, errors.New("Error storing approvals record") }
+
+	return false, nil
+}
+
+//==============================================================================================================================
+//	 clear_approvals - Forgets the approvals of an action once it completes, or once a trade is rejected or expires, so
+//					   they don't count towards the next one
+//==============================================================================================================================
+func (t *SimpleChaincode) clear_approvals(stub shim.ChaincodeStubInterface, invoiceId string, action string, subject string) error {
+
+	err := stub.DelState(approvals_key(invoiceId, action, subject))
+	if err != nil { return errors.New("Error clearing approvals for invoice " + invoiceId) }
+
+	return nil
+}
+
+//=================================================================================================================================
+//	 set_approval_policy - A payer registers or replaces the policy its invoices are approved under
+//=================================================================================================================================
+func (t *SimpleChaincode) set_approval_policy(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//Args
+	//				0
+	//	{"rules":[{"minamount":"0","required":2,"signatories":["cfo","treasurer","ceo","controller"]}]}
+
+	err := identity.CheckArgs(args, 1)
+	if err != nil { return nil, err }
+
+	var policy Approval_Policy
+
+	err = json.Unmarshal([]byte(args[0]), &policy)
+	if err != nil { return nil, errors.New("Invalid approval policy JSON") }
+
+	if len(policy.Rules) == 0 { return nil, errors.New("An approval policy needs at least one rule") }
+
+	for i, r := range policy.Rules {
+		_, err = strconv.ParseFloat(r.MinAmount, 64)
+		if err != nil { return nil, errors.New("Approval rule amount is not numeric: " + r.MinAmount) }
+
+		signatories := []string{}													// A signatory listed twice still only approves once
+		for _, name := range r.Signatories {
+			if !contains(signatories, name) { signatories = append(signatories, name) }
+		}
+		policy.Rules[i].Signatories = signatories
+
+		if r.Required < 1 || r.Required > len(signatories) {
+			return nil, errors.New(fmt.Sprintf("Approval rule needs between 1 and %v signatories, not %v", len(signatories), r.Required))
+		}
+	}
+
+	policy.Payer = caller
+
+	bytes, err := json.Marshal(policy)
+	if err != nil { return nil, errors.New("Error converting approval policy record") }
+
+	err = stub.PutState(policy_key(caller), bytes)
+	if err != nil { return nil, errors.New("Error storing approval policy record") }
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 get_approval_policy
+//=================================================================================================================================
+func (t *SimpleChaincode) get_approval_policy(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//Args
+	//				0
+	//			test_user1
+
+	if len(args) != 1 { return nil, errors.New("Incorrect number of arguments. Expecting 1") }
+
+	policy, err := t.retrieve_policy(stub, args[0])
+	if err != nil { return nil, err }
+	if policy == nil { return nil, errors.New("No approval policy for " + args[0]) }
+
+	return json.Marshal(policy)
+}
+
+//=================================================================================================================================
+//	 get_approvals - Returns the approvals collected so far for an invoice's current trade, or for approving it into a
+//					 program when the program is given
+//=================================================================================================================================
+func (t *SimpleChaincode) get_approvals(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//Args
+	//				0
+	//			123443232
+	//	or
+	//				0               1
+	//			123443232        prog001
+
+	if len(args) != 1 && len(args) != 2 { return nil, errors.New("Incorrect number of arguments. Expecting 1 or 2") }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return nil, err }
+
+	signatory, err := t.is_payer_signatory(stub, inv, caller)
+	if err != nil { return nil, err }
+
+	if !signatory && inv.Supplier != caller && inv.Buyer != caller && inv.Payer != caller {
+		return nil, errors.New("Permission Denied. get_approvals")
+	}
+
+	action, subject := APPROVE_TRADE, inv.Buyer
+	if len(args) == 2 { action, subject = APPROVE_PROGRAM, args[1] }
+
+	bytes, err := stub.GetState(approvals_key(inv.InvoiceId, action, subject))
+	if err != nil { return nil, errors.New("Unable to get approvals for invoice " + inv.InvoiceId) }
+
+	if bytes == nil {
+		return json.Marshal(Approvals{InvoiceId: inv.InvoiceId, Action: action, Subject: subject, Signatories: []string{}})
+	}
+
+	return bytes, nil
+}
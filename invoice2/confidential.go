@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	 Confidential invoices
+//==============================================================================================================================
+//	An invoice created with a key in the transaction metadata has its amount, discount and payer stored encrypted with
+//	AES-256-GCM. Only the key's SHA-256 hash is kept in world state, so the supplier shares the key with the payer and
+//	buyer off-chain and every invoke or query on the invoice must carry it again. The generic read query only ever
+//	sees the ciphertext.
+//
+//	This only protects world state. Fabric 0.6 stores the caller metadata with the transaction in the block, so the
+//	key of every invoke that carried it is on the blockchain next to the ciphertext, and anyone who can read the
+//	blocks can decrypt the invoice. Unless the network encrypts transactions (security and privacy enabled), treat
+//	this as keeping the values out of state queries, not out of reach of the peers. The records derived from an invoice, such as its escrow, obligation and ledger entries, hold
+//	amounts and parties in the clear, so they are kept under keys containing ':' which read refuses.
+//
+//	Every validating peer must write identical state, so the GCM nonce can't be random. It is derived from the key,
+//	transaction ID, invoice, field and plaintext instead, which keeps it unique for each distinct encryption.
+//==============================================================================================================================
+
+const   SEALED_PREFIX  =  "enc:"
+
+var ERR_INVOICE_SEALED = errors.New("This invoice is confidential. Supply its key as {\"invoicekey\":\"<base64>\"} in the transaction metadata")
+
+//==============================================================================================================================
+//	Transient Data - The JSON the caller passes in the transaction metadata
+//==============================================================================================================================
+type Transient_Data struct {
+	InvoiceKey       string `json:"invoicekey"`
+}
+
+//==============================================================================================================================
+//	 get_invoice_key - Returns the 32 byte key from the transaction metadata, or nil if none was supplied
+//==============================================================================================================================
+func (t *SimpleChaincode) get_invoice_key(stub shim.ChaincodeStubInterface) ([]byte, error) {
+
+	metadata, err := stub.GetCallerMetadata()
+	if err != nil { return nil, errors.New("Couldn't read transaction metadata. Error: " + err.Error()) }
+	if len(metadata) == 0 { return nil, nil }
+
+	var data Transient_Data
+
+	err = json.Unmarshal(metadata, &data)
+	if err != nil { return nil, errors.New("Transaction metadata is not valid JSON") }
+	if data.InvoiceKey == "" { return nil, nil }
+
+	key, err := base64.StdEncoding.DecodeString(data.InvoiceKey)
+	if err != nil || len(key) != 32 { return nil, errors.New("invoicekey must be 32 bytes, base64 encoded") }
+
+	return key, nil
+}
+
+func key_hash(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:])
+}
+
+//==============================================================================================================================
+//	 seal_field / open_field - Encrypt and decrypt a single field. The invoice ID and field name are bound in as
+//							   additional data so a ciphertext can't be moved to another field or invoice.
+//==============================================================================================================================
+func seal_field(key []byte, txid string, invoiceId string, field string, value string) (string, error) {
+
+	block, err := aes.NewCipher(key)
+	if err != nil { return "", err }
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil { return "", err }
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(txid + "|" + invoiceId + "|" + field + "|" + value))
+	nonce := mac.Sum(nil)[:gcm.NonceSize()]
+
+	sealed := gcm.Seal(nonce, nonce, []byte(value), []byte(invoiceId + "|" + field))
+
+	return SEALED_PREFIX + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func open_field(key []byte, invoiceId string, field string, value string) (string, error) {
+
+	if !strings.HasPrefix(value, SEALED_PREFIX) { return "", errors.New("Field " + field + " is not encrypted") }
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, SEALED_PREFIX))
+	if err != nil { return "", errors.New("Corrupt ciphertext in field " + field) }
+
+	block, err := aes.NewCipher(key)
+	if err != nil { return "", err }
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil { return "", err }
+
+	if len(sealed) < gcm.NonceSize() { return "", errors.New("Corrupt ciphertext in field " + field) }
+
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(invoiceId + "|" + field))
+	if err != nil { return "", errors.New("Couldn't decrypt field " + field) }
+
+	return string(plain), nil
+}
+
+//==============================================================================================================================
+//	 seal_invoice - Returns the form of a confidential invoice that is written to the world state
+//==============================================================================================================================
+func (t *SimpleChaincode) seal_invoice(stub shim.ChaincodeStubInterface, inv Invoice) (Invoice, error) {
+
+	if inv.KeyHash == "" { return inv, nil }
+
+	key, err := t.get_invoice_key(stub)
+	if err != nil { return inv, err }
+	if key == nil || key_hash(key) != inv.KeyHash { return inv, ERR_INVOICE_SEALED }
+
+	txid := stub.GetTxID()
+
+	if inv.Amount, err = seal_field(key, txid, inv.InvoiceId, "amount", inv.Amount); err != nil { return inv, err }
+	if inv.Discount, err = seal_field(key, txid, inv.InvoiceId, "discount", inv.Discount); err != nil { return inv, err }
+	if inv.Payer, err = seal_field(key, txid, inv.InvoiceId, "payer", inv.Payer); err != nil { return inv, err }
+
+	return inv, nil
+}
+
+//==============================================================================================================================
+//	 open_invoice - Decrypts a stored confidential invoice with the key from the transaction metadata. Returns the
+//					sealed invoice with ERR_INVOICE_SEALED if the caller didn't supply the right key.
+//==============================================================================================================================
+func (t *SimpleChaincode) open_invoice(stub shim.ChaincodeStubInterface, inv Invoice) (Invoice, error) {
+
+	if inv.KeyHash == "" { return inv, nil }
+
+	key, err := t.get_invoice_key(stub)
+	if err != nil { return inv, err }
+	if key == nil || key_hash(key) != inv.KeyHash { return inv, ERR_INVOICE_SEALED }
+
+	sealed := inv
+
+	if inv.Amount, err = open_field(key, inv.InvoiceId, "amount", inv.Amount); err != nil { return sealed, err }
+	if inv.Discount, err = open_field(key, inv.InvoiceId, "discount", inv.Discount); err != nil { return sealed, err }
+	if inv.Payer, err = open_field(key, inv.InvoiceId, "payer", inv.Payer); err != nil { return sealed, err }
+
+	return inv, nil
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sreedhar310/learn-chaincode/identity"
+	"github.com/sreedhar310/learn-chaincode/ledger"
+	"github.com/sreedhar310/learn-chaincode/validate"
+)
+
+//==============================================================================================================================
+//	 Escrow states and settings
+//==============================================================================================================================
+
+const   ESCROW_HELD      =  "held"
+const   ESCROW_RELEASED  =  "released"
+const   ESCROW_REFUNDED  =  "refunded"
+
+const   ESCROW_PERIOD  int64  =  7 * 24 * 60 * 60		// Seconds a buyer's funds stay locked waiting for the payer before the trade can be expired
+
+//==============================================================================================================================
+//	Account - Defines the cash balance a participant holds in this chaincode. Buyers fund their trades from it and
+//			  suppliers are paid into it when the payer approves.
+//==============================================================================================================================
+type Account struct {
+	Owner            string `json:"owner"`
+	Currency         string `json:"currency"`
+	Balance          string `json:"balance"`
+}
+
+//==============================================================================================================================
+//	Escrow - Defines the funds locked from the buyer's account when an invoice is accepted. Expiry is the unix time
+//			 (seconds) after which the trade can be expired and the funds refunded.
+//==============================================================================================================================
+type Escrow struct {
+	InvoiceId        string `json:"invoiceid"`
+	Buyer            string `json:"buyer"`
+	Supplier         string `json:"supplier"`
+	Amount           string `json:"amount"`
+	Currency         string `json:"currency"`
+	Status           string `json:"status"`
+	Expiry           int64  `json:"expiry"`
+}
+
+//==============================================================================================================================
+//	Escrow Holder - Holds the invoiceIDs of every escrow a buyer has ever funded. Used as an index when querying a
+//					buyer's escrows. Escrows are kept per invoice and buyer, so an invoice that is sold again after
+//					a rejected or expired trade never shows the earlier buyer the next one's escrow.
+//==============================================================================================================================
+type Escrow_Holder struct {
+	Invoices 	[]string `json:"invoices"`
+}
+
+//	Keys contain ':', which invoice IDs can't, so an invoice can never be created over an account or escrow record
+func account_key(name string) string { return "account:" + name }
+func escrow_key(invoiceId string, buyer string) string { return "escrow:" + invoiceId + ":" + buyer }
+func buyer_escrows_key(buyer string) string { return "escrows:" + buyer }
+
+//==============================================================================================================================
+//	 get_tx_time - Returns the transaction timestamp in unix seconds. Used instead of the local clock so that every
+//				   peer reaches the same decision.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_tx_time(stub shim.ChaincodeStubInterface) (int64, error) {
+
+	ts, err := stub.GetTxTimestamp()
+	if err != nil { return 0, errors.New("Couldn't get transaction timestamp. Error: " + err.Error()) }
+	return ts.Seconds, nil
+}
+
+//==============================================================================================================================
+//	 purchase_price - The amount a buyer pays for an invoice, i.e. the invoice amount less a discount, rounded to the
+//					  cent so that the amount debited and the amount held in escrow are the same. The discount is the
+//					  invoice's own on the market and the program rate when a program funder pays early.
+//==============================================================================================================================
+func purchase_price(inv Invoice, rate string) (float64, error) {
+
+	amount, err := strconv.ParseFloat(inv.Amount, 64)
+	if err != nil { return 0, errors.New("Invoice amount is not numeric: " + inv.Amount) }
+
+	discount := 0.0
+	if rate != "" && rate != "UNDEFINED" {
+		discount, err = strconv.ParseFloat(rate, 64)
+		if err != nil { return 0, errors.New("Discount is not numeric: " + rate) }
+	}
+
+	return float64(to_cents(amount * (1 - discount))) / 100, nil
+}
+
+//==============================================================================================================================
+//	 retrieve_account - Gets a participant's account. If create is set a missing account is returned empty with the
+//						currency given instead of failing.
+//==============================================================================================================================
+func (t *SimpleChaincode) retrieve_account(stub shim.ChaincodeStubInterface, owner string, currency string, create bool) (Account, error) {
+
+	var acc Account
+
+	bytes, err := stub.GetState(account_key(owner))
+	if err != nil { return acc, errors.New("RETRIEVE_ACCOUNT: Error retrieving account for " + owner) }
+
+	if bytes == nil {
+		if !create { return acc, errors.New("RETRIEVE_ACCOUNT: No account for " + owner) }
+		return Account{Owner: owner, Currency: currency, Balance: "0.00"}, nil
+	}
+
+	err = json.Unmarshal(bytes, &acc)
+	if err != nil { return acc, errors.New("RETRIEVE_ACCOUNT: Corrupt account record " + string(bytes)) }
+
+	return acc, nil
+}
+
+func (t *SimpleChaincode) save_account(stub shim.ChaincodeStubInterface, acc Account) error {
+
+	bytes, err := json.Marshal(acc)
+	if err != nil { return errors.New("Error converting account record") }
+
+	err = stub.PutState(account_key(acc.Owner), bytes)
+	if err != nil { return errors.New("Error storing account record") }
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 adjust_balance - Adds delta (which may be negative) to an account, refusing to take it below zero
+//==============================================================================================================================
+func (t *SimpleChaincode) adjust_balance(stub shim.ChaincodeStubInterface, owner string, currency string, delta float64) error {
+
+	acc, err := t.retrieve_account(stub, owner, currency, delta > 0)
+	if err != nil { return err }
+
+	if acc.Currency != currency {
+		return errors.New(fmt.Sprintf("Account %v is held in %v, not %v", owner, acc.Currency, currency))
+	}
+
+	balance, err := strconv.ParseFloat(acc.Balance, 64)
+	if err != nil { return errors.New("Account balance is not numeric: " + acc.Balance) }
+
+	if balance + delta < 0 {
+		return errors.New(owner + " doesn't have enough balance to complete transaction")
+	}
+
+	acc.Balance = strconv.FormatFloat(balance + delta, 'f', 2, 64)
+
+	return t.save_account(stub, acc)
+}
+
+//==============================================================================================================================
+//	 init_account - Opens an empty cash account for the caller. Only fund_account puts money into it.
+//==============================================================================================================================
+func (t *SimpleChaincode) init_account(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//Args
+	//				0
+	//			   USD
+
+	err := identity.CheckArgs(args, 1)
+	if err != nil { return nil, err }
+
+	err = validate.Currency(args[0])
+	if err != nil { return nil, err }
+
+	bytes, err := stub.GetState(account_key(caller))
+	if err != nil { return nil, errors.New("Failed to get account") }
+	if bytes != nil { return nil, errors.New("This account already exists") }
+
+	return nil, t.save_account(stub, Account{Owner: caller, Currency: args[0], Balance: "0.00"})
+}
+
+//==============================================================================================================================
+//	 fund_account - Credits a participant's account with money paid in from outside the network. The deposit is booked
+//					against suspense until it is reconciled with the bank. Admins only.
+//==============================================================================================================================
+func (t *SimpleChaincode) fund_account(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//Args
+	//				0              1
+	//			test_user2      5000.00
+
+	err := identity.CheckArgs(args, 2)
+	if err != nil { return nil, err }
+
+	amount, err := validate.Money(args[1])
+	if err != nil { return nil, err }
+
+	acc, err := t.retrieve_account(stub, args[0], "", false)
+	if err != nil { return nil, err }
+
+	err = t.adjust_balance(stub, acc.Owner, acc.Currency, amount)
+	if err != nil { return nil, err }
+
+	err = ledger.Post(stub, "funding for " + acc.Owner,
+		ledger.Debit(ledger.Suspense, acc.Currency, amount),
+		ledger.Credit(ledger.Customer(acc.Owner), acc.Currency, amount))
+	if err != nil { return nil, err }
+
+	return nil, nil
+}
+
+//==============================================================================================================================
+//	 retrieve_escrow
+//==============================================================================================================================
+func (t *SimpleChaincode) retrieve_escrow(stub shim.ChaincodeStubInterface, invoiceId string, buyer string) (Escrow, error) {
+
+	var esc Escrow
+
+	bytes, err := stub.GetState(escrow_key(invoiceId, buyer))
+	if err != nil { return esc, errors.New("RETRIEVE_ESCROW: Error retrieving escrow for invoice " + invoiceId) }
+	if bytes == nil { return esc, errors.New("RETRIEVE_ESCROW: No escrow for invoice " + invoiceId + " funded by " + buyer) }
+
+	err = json.Unmarshal(bytes, &esc)
+	if err != nil { return esc, errors.New("RETRIEVE_ESCROW: Corrupt escrow record " + string(bytes)) }
+
+	return esc, nil
+}
+
+func (t *SimpleChaincode) save_escrow(stub shim.ChaincodeStubInterface, esc Escrow) error {
+
+	bytes, err := json.Marshal(esc)
+	if err != nil { return errors.New("Error converting escrow record") }
+
+	err = stub.PutState(escrow_key(esc.InvoiceId, esc.Buyer), bytes)
+	if err != nil { return errors.New("Error storing escrow record") }
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 lock_escrow - Debits the purchase price from the buyer's account and records it against the invoice
+//==============================================================================================================================
+func (t *SimpleChaincode) lock_escrow(stub shim.ChaincodeStubInterface, inv Invoice, buyer string, price float64) error {
+
+	now, err := t.get_tx_time(stub)
+	if err != nil { return err }
+
+	err = t.adjust_balance(stub, buyer, inv.Currency, -price)
+	if err != nil { return err }
+
+	err = ledger.Post(stub, "escrow for invoice " + inv.InvoiceId,
+		ledger.Debit(ledger.Customer(buyer), inv.Currency, price),
+		ledger.Credit(ledger.Escrow, inv.Currency, price))
+	if err != nil { return err }
+
+	esc := Escrow{
+		InvoiceId: inv.InvoiceId,
+		Buyer:     buyer,
+		Supplier:  inv.Supplier,
+		Amount:    strconv.FormatFloat(price, 'f', 2, 64),
+		Currency:  inv.Currency,
+		Status:    ESCROW_HELD,
+		Expiry:    now + ESCROW_PERIOD,
+	}
+
+	err = t.save_escrow(stub, esc)
+	if err != nil { return err }
+
+	var holder Escrow_Holder
+
+	bytes, err := stub.GetState(buyer_escrows_key(buyer))
+	if err != nil { return errors.New("Unable to get escrow index for " + buyer) }
+
+	if bytes != nil {
+		err = json.Unmarshal(bytes, &holder)
+		if err != nil { return errors.New("Corrupt Escrow_Holder record") }
+	}
+
+	for _, id := range holder.Invoices {
+		if id == inv.InvoiceId { return nil }
+	}
+
+	holder.Invoices = append(holder.Invoices, inv.InvoiceId)
+
+	bytes, err = json.Marshal(holder)
+	if err != nil { return errors.New("Error creating Escrow_Holder record") }
+
+	err = stub.PutState(buyer_escrows_key(buyer), bytes)
+	if err != nil { return errors.New("Unable to put the escrow index") }
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 settle_escrow - Pays out the escrow a buyer holds for an invoice, either to the supplier (ESCROW_RELEASED) or back to
+//					 the buyer (ESCROW_REFUNDED)
+//==============================================================================================================================
+func (t *SimpleChaincode) settle_escrow(stub shim.ChaincodeStubInterface, invoiceId string, buyer string, outcome string) error {
+
+	esc, err := t.retrieve_escrow(stub, invoiceId, buyer)
+	if err != nil { return err }
+
+	if esc.Status != ESCROW_HELD {
+		return errors.New(fmt.Sprintf("Escrow for invoice %v is already %v", invoiceId, esc.Status))
+	}
+
+	amount, err := strconv.ParseFloat(esc.Amount, 64)
+	if err != nil { return errors.New("Escrow amount is not numeric: " + esc.Amount) }
+
+	payee := esc.Buyer
+	if outcome == ESCROW_RELEASED { payee = esc.Supplier }
+
+	err = t.adjust_balance(stub, payee, esc.Currency, amount)
+	if err != nil { return err }
+
+	err = ledger.Post(stub, "escrow " + outcome + " for invoice " + invoiceId,
+		ledger.Debit(ledger.Escrow, esc.Currency, amount),
+		ledger.Credit(ledger.Customer(payee), esc.Currency, amount))
+	if err != nil { return err }
+
+	esc.Status = outcome
+
+	return t.save_escrow(stub, esc)
+}
+
+//==============================================================================================================================
+//	 expire_trade - Returns an accepted invoice to the market and refunds the buyer once the payer has let the escrow
+//					period run out. Anyone may call it, the transaction timestamp decides.
+//==============================================================================================================================
+func (t *SimpleChaincode) expire_trade(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//Args
+	//				0
+	//			123443232
+
+	if len(args) != 1 { return nil, errors.New("Incorrect number of arguments. Expecting 1") }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return nil, err }
+
+	if inv.Status != "1" {
+		return nil, errors.New("Permission Denied. expire_trade. This invoice isn't waiting for payer approval")
+	}
+
+	esc, err := t.retrieve_escrow(stub, inv.InvoiceId, inv.Buyer)
+	if err != nil { return nil, err }
+
+	now, err := t.get_tx_time(stub)
+	if err != nil { return nil, err }
+
+	if now < esc.Expiry {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. expire_trade. Escrow for invoice %v doesn't expire until %v", inv.InvoiceId, esc.Expiry))
+	}
+
+	err = t.settle_escrow(stub, inv.InvoiceId, inv.Buyer, ESCROW_REFUNDED)
+	if err != nil { return nil, err }
+
+	err = t.clear_approvals(stub, inv.InvoiceId, APPROVE_TRADE, inv.Buyer)
+	if err != nil { return nil, err }
+
+	inv.Status = "0"
+	inv.Buyer = "UNDEFINED"
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("EXPIRE_TRADE: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 get_escrow - Returns the escrow a buyer funded for an invoice, the current buyer's if none is given. Only that
+//				  buyer, the supplier and the payer may see it.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_escrow(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//Args
+	//				0			  1
+	//			123443232	 [test_user1]
+
+	if len(args) != 1 && len(args) != 2 { return nil, errors.New("Incorrect number of arguments. Expecting an invoice and optionally a buyer") }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return nil, err }
+
+	buyer := inv.Buyer
+	if len(args) == 2 { buyer = args[1] }
+
+	if inv.Supplier != caller && buyer != caller && inv.Payer != caller {
+		return nil, errors.New("Permission Denied. get_escrow")
+	}
+
+	esc, err := t.retrieve_escrow(stub, args[0], buyer)
+	if err != nil { return nil, err }
+
+	return json.Marshal(esc)
+}
+
+//=================================================================================================================================
+//	 get_buyer_escrows - Returns every escrow the calling buyer has funded along with the total still held, per currency
+//=================================================================================================================================
+func (t *SimpleChaincode) get_buyer_escrows(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//Args
+	//	none, the caller's escrows are returned
+
+	err := identity.CheckArgs(args, 0)
+	if err != nil { return nil, err }
+
+	var holder Escrow_Holder
+
+	bytes, err := stub.GetState(buyer_escrows_key(caller))
+	if err != nil { return nil, errors.New("Unable to get escrow index for " + caller) }
+
+	if bytes != nil {
+		err = json.Unmarshal(bytes, &holder)
+		if err != nil { return nil, errors.New("Corrupt Escrow_Holder record") }
+	}
+
+	type Buyer_Escrows struct {
+		Buyer    string             `json:"buyer"`
+		Held     map[string]string  `json:"held"`
+		Escrows  []Escrow           `json:"escrows"`
+	}
+
+	result := Buyer_Escrows{Buyer: caller, Held: map[string]string{}, Escrows: []Escrow{}}
+	totals := map[string]float64{}
+
+	for _, invoiceId := range holder.Invoices {
+
+		esc, err := t.retrieve_escrow(stub, invoiceId, caller)
+		if err != nil { return nil, err }
+
+		if esc.Status == ESCROW_HELD {
+			amount, err := strconv.ParseFloat(esc.Amount, 64)
+			if err != nil { return nil, errors.New("Escrow amount is not numeric: " + esc.Amount) }
+			totals[esc.Currency] += amount
+		}
+
+		result.Escrows = append(result.Escrows, esc)
+	}
+
+	for currency, total := range totals {
+		result.Held[currency] = strconv.FormatFloat(total, 'f', 2, 64)
+	}
+
+	return json.Marshal(result)
+}
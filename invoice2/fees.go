@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sreedhar310/learn-chaincode/fees"
+	"github.com/sreedhar310/learn-chaincode/identity"
+	"github.com/sreedhar310/learn-chaincode/ledger"
+)
+
+//==============================================================================================================================
+//	 Fees - Admins set a fee schedule per operation and currency and name the participant whose account fees in each
+//			currency are paid into. The fee is debited from the paying participant's account on top of the amount,
+//			in the same transaction, so either both go through or neither does.
+//==============================================================================================================================
+
+//	feeOperations - The operations collect_fee is called for, the only ones a fee rule can be set on
+var feeOperations = []string{"accept_trade"}
+
+//==============================================================================================================================
+//	 collect_fee - Pays the fee for an operation on an amount from a participant's account into the fee account, if
+//				   one is due
+//==============================================================================================================================
+func (t *SimpleChaincode) collect_fee(stub shim.ChaincodeStubInterface, operation string, payer string, currency string, amount float64) error {
+
+	fee, feeOwner, err := fees.Quote(stub, operation, currency, amount)
+	if err != nil { return err }
+	if fee <= 0 || feeOwner == payer { return nil }
+
+	err = t.adjust_balance(stub, payer, currency, -fee)
+	if err != nil { return errors.New("Unable to pay the " + operation + " fee: " + err.Error()) }
+
+	err = t.adjust_balance(stub, feeOwner, currency, fee)
+	if err != nil { return errors.New("Fee account unavailable: " + err.Error()) }
+
+	err = ledger.Post(stub, operation + " fee " + payer,
+		ledger.Debit(ledger.Customer(payer), currency, fee),
+		ledger.Credit(ledger.Customer(feeOwner), currency, fee))
+	if err != nil { return err }
+
+	return fees.Collected(stub, operation, currency, fee)
+}
+
+//==============================================================================================================================
+//	 set_fee_rule - Charges a fee for an operation in a currency. Admins only.
+//==============================================================================================================================
+func (t *SimpleChaincode) set_fee_rule(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//Args
+	//				0            1      2       3        4     5
+	//			accept_trade    USD    0.5    0.001     1     25
+
+	err := identity.CheckArgs(args, 6)
+	if err != nil { return nil, err }
+
+	rule, err := fees.ParseRule(args, feeOperations)
+	if err != nil { return nil, err }
+
+	return nil, fees.SetRule(stub, rule)
+}
+
+//==============================================================================================================================
+//	 remove_fee_rule - Makes an operation free again in a currency. Admins only.
+//==============================================================================================================================
+func (t *SimpleChaincode) remove_fee_rule(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//Args
+	//				0            1
+	//			accept_trade    USD
+
+	err := identity.CheckArgs(args, 2)
+	if err != nil { return nil, err }
+
+	return nil, fees.RemoveRule(stub, args[0], args[1])
+}
+
+//==============================================================================================================================
+//	 set_fee_account - Names the participant whose account fees in its currency are paid into. The account has to be
+//					   open already. Admins only.
+//==============================================================================================================================
+func (t *SimpleChaincode) set_fee_account(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//Args
+	//				0
+	//			platform_fees
+
+	err := identity.CheckArgs(args, 1)
+	if err != nil { return nil, err }
+
+	acc, err := t.retrieve_account(stub, args[0], "", false)
+	if err != nil { return nil, err }
+
+	return nil, fees.SetAccount(stub, acc.Currency, acc.Owner)
+}
+
+//==============================================================================================================================
+//	 get_fee_schedule - Returns the fee rules and fee accounts
+//==============================================================================================================================
+func (t *SimpleChaincode) get_fee_schedule(stub shim.ChaincodeStubInterface) ([]byte, error) {
+
+	schedule, err := fees.GetSchedule(stub)
+	if err != nil { return nil, err }
+
+	return json.Marshal(schedule)
+}
@@ -1,478 +1,663 @@
-package main
-
-import (
-	"errors"
-	"fmt"
-	"github.com/hyperledger/fabric/core/chaincode/shim"
-	"encoding/json"
-)
-
-//==============================================================================================================================
-//	 Participant roles
-//==============================================================================================================================
-
-const   SUPPLIER   =  "supplier"
-const   PAYER   =  "payer"
-const   BUYER =  "buyer"
-
-
-//==============================================================================================================================
-//	Structure Definitions
-//==============================================================================================================================
-//	Chaincode - A blank struct for use with Shim (A HyperLedger included go file used for get/put state
-//				and other HyperLedger functions)
-//==============================================================================================================================
-type  SimpleChaincode struct {
-}
-
-//==============================================================================================================================
-//	Invoice - Defines the structure for a invoice object. JSON on right tells it what JSON fields to map to
-//			  that element when reading a JSON object into the struct e.g. JSON amount -> Struct Amount.
-//==============================================================================================================================
-type Invoice struct {
-	InvoiceId        string `json:"invoiceid"`
-	Amount           string `json:"amount"`
-	Currency         string `json:"currency"`
-	Supplier         string `json:"supplier"`
-	Payer            string `json:"payer"`
-	DueDate          string `json:"duedate"`
-	Status           string `json:"status"`
-	Buyer            string `json:"buyer"`
-	Discount         string `json:"discount"`
-
-}
-
-
-//==============================================================================================================================
-//	Invoice Holder - Defines the structure that holds all the invoiceIDs for invoices that have been created.
-//				     Used as an index when querying all invoices.
-//==============================================================================================================================
-
-type Invoice_Holder struct {
-	Invoices 	[]string `json:"invoices"`
-}
-
-
-//==============================================================================================================================
-//	Init Function - Called when the user deploys the chaincode
-//==============================================================================================================================
-func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-
-	//Args
-	//				0              1             2            3            4            5
-	//			test_user0      supplier    test_user1      payer      test_user2     buyer
-
-	var invoiceIDs Invoice_Holder
-
-	bytes, err := json.Marshal(invoiceIDs)
-
-    if err != nil { return nil, errors.New("Error creating Invoice_Holder record") }
-
-	err = stub.PutState("invoiceIDs", bytes)
-	if err != nil { return nil, errors.New("Error putting state with invoiceIDs") }
-
-	// save the role of users in the world state  (LATER, MAY USE TCERT ATTRIBUTES)
-	for i:=0; i < len(args); i=i+2 {
-		t.add_particants(stub, args[i], args[i+1])
-	}
-
-	return nil, nil
-}
-
-//==============================================================================================================================
-//	 General Functions: add_particants and get_role
-//==============================================================================================================================
-
-func (t *SimpleChaincode) add_particants(stub shim.ChaincodeStubInterface, name string, role string) ([]byte, error) {
-
-	err := stub.PutState(name, []byte(role))
-
-	if err != nil {
-		return nil, errors.New("Error storing user " + name + " role: " + role)
-	}
-
-	return nil, nil
-
-}
-
-func (t *SimpleChaincode) get_role(stub shim.ChaincodeStubInterface, name string) (string, error) {
-
-	role, err := stub.GetState(name)
-	if err != nil { return "", errors.New("Couldn't retrieve role for user " + name) }
-	return string(role), nil
-}
-
-
-//==============================================================================================================================
-//	 retrieve_invoice
-//==============================================================================================================================
-func (t *SimpleChaincode) retrieve_invoice(stub shim.ChaincodeStubInterface, invoiceId string) (Invoice, error) {
-
-	var inv Invoice
-
-	bytes, err := stub.GetState(invoiceId);
-
-	if err != nil { return inv, errors.New("RETRIEVE_INVOICE: Error retrieving invoice with invoice Id = " + invoiceId) }
-
-	err = json.Unmarshal(bytes, &inv);
-
-    if err != nil { return inv, errors.New("RETRIEVE_INVOICE: Corrupt invoice record "+string(bytes))	}
-
-	return inv, nil
-}
-
-//==============================================================================================================================
-// save_changes - Writes to the ledger the Vehicle struct passed in a JSON format. Uses the shim file's
-//				  method 'PutState'.
-//==============================================================================================================================
-func (t *SimpleChaincode) save_changes(stub shim.ChaincodeStubInterface, inv Invoice) (bool, error) {
-
-	bytes, err := json.Marshal(inv)
-
-	if err != nil { return false, errors.New("Error converting invoice record") }
-
-	err = stub.PutState(inv.InvoiceId, bytes)
-
-	if err != nil { return false, errors.New("Error storing invoice record") }
-
-	return true, nil
-}
-
-//==============================================================================================================================
-//	 Router Functions
-//==============================================================================================================================
-//	Invoke - Called on chaincode invoke. Takes a function name passed and calls that function. Converts some
-//		  initial arguments passed to other things for use in the called function.
-//==============================================================================================================================
-func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-
-
-	if function == "create_invoice" {
-        return t.create_invoice(stub, args)
-	} else if function == "approve_trade"{
-		return t.approve_trade(stub, args)
-	} else if function == "reject_trade"{
-		return t.reject_trade(stub, args)
-	} else if function == "accept_trade"{
-		return t.accept_trade(stub, args)
-	}
-
-    return nil, errors.New("Received unknown function invocation: " + function)
-}
-//=================================================================================================================================
-//	Query - Called on chaincode query. Takes a function name passed and calls that function. Passes the
-//  		initial arguments passed are passed on to the called function.
-//=================================================================================================================================
-func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-
-	if function == "get_invoice_details" {
-		if len(args) != 2 { return nil, errors.New("QUERY: Incorrect number of arguments passed") }
-		inv, err := t.retrieve_invoice(stub, args[0])
-		if err != nil { return nil, errors.New("QUERY: Error retrieving invoice "+err.Error()) }
-		return t.get_invoice_details(stub, inv, args[1])
-	}  else if function == "get_invoices" {
-		return t.get_invoices(stub, args)
-	}  else if function == "get_opening_trade_invoices" {
-		return t.get_opening_trade_invoices(stub, args)
-	}  else if function == "read" {											
-		return t.read(stub, args)
-	}  else if function == "get_username" {			
-		return stub.ReadCertAttribute("username");
-	} 
-
-	return nil, errors.New("Received unknown function query " + function)
-
-}
-
-
-func (t *SimpleChaincode) read(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var name, jsonResp string
-	var err error
-
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting name of the var to query")
-	}
-
-	name = args[0]
-	valAsbytes, err := stub.GetState(name)									//get the var from chaincode state
-	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + name + "\"}"
-		return nil, errors.New(jsonResp)
-	}
-
-	return valAsbytes, nil													//send it onward
-}
-
-//=================================================================================================================================
-//	 Create Function
-//=================================================================================================================================
-//	 Create Invoice - Creates the initial JSON for the invoice and then saves it to the ledger.
-//=================================================================================================================================
-func (t *SimpleChaincode) create_invoice(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-
-	//Args
-	//				0               1              2              3            4
-	//			123443232        100.00           0.05        test_user0    test_user1
-
-	var inv Invoice
-
-	var invoiceId = args[0]
-
-	invoice_json := `{ "invoiceid": "` + invoiceId + `", "amount": "` + args[1] + `", "currency": "USD", "supplier": "` + args[3] + `", "payer": "` + args[4] + `", "duedate": "UNDEFINED", "status": "0", "buyer":"UNDEFINED", "discount":"` + args[2] + `"}`
-
-	err := json.Unmarshal([]byte(invoice_json), &inv)							// Convert the JSON defined above into a vehicle object for go
-
-	if err != nil { return nil, errors.New("Invalid JSON object") }
-
-	record, err := stub.GetState(inv.InvoiceId) 								// If not an error then a record exists so cant create a new car with this V5cID as it must be unique
-
-	if record != nil { return nil, errors.New("Invoice already exists") }
-
-	var role string
-	var role2 string
-	
-	role, err = t.get_role(stub,args[3])
-
-	if 	role != SUPPLIER {			
-
-		return nil, errors.New(fmt.Sprintf("Permission Denied. create_invoice. %v !== %v", role, SUPPLIER))
-
-	}
-
-	role2, err = t.get_role(stub, args[4])
-
-	if 	role2 != PAYER {			
-
-		return nil, errors.New(fmt.Sprintf("Permission Denied. create_invoice. %v !== %v", role2, PAYER))
-
-	}
-
-
-	_, err  = t.save_changes(stub, inv)
-
-	if err != nil { fmt.Printf("CREATE_INVOICE: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
-
-	bytes, err := stub.GetState("invoiceIDs")
-
-	if err != nil { return nil, errors.New("Unable to get invoiceIDs") }
-
-	var invoiceIDs Invoice_Holder
-
-	err = json.Unmarshal(bytes, &invoiceIDs)
-
-	if err != nil {	return nil, errors.New("Corrupt Invoice_Holder record") }
-
-	invoiceIDs.Invoices = append(invoiceIDs.Invoices, invoiceId)
-
-	bytes, err = json.Marshal(invoiceIDs)
-
-	if err != nil { fmt.Print("Error creating Invoice_Holder record") }
-
-	err = stub.PutState("invoiceIDs", bytes)
-
-	if err != nil { return nil, errors.New("Unable to put the state") }
-
-	return nil, nil
-
-}
-
-
-
-func (t *SimpleChaincode) accept_trade(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-
-	//Args
-	//				0                 1
-	//			123443232         test_user2
-	var inv Invoice
-	var role string
-	var invoiceId = args[0]
-
-	var caller = args[1]
-
-	inv, err := t.retrieve_invoice(stub, invoiceId)
-
-	role, err = t.get_role(stub, caller);
-	if 	role != BUYER {						
-		return nil, errors.New(fmt.Sprintf("Permission Denied. accept_trade. %v !== %v", role, BUYER))
-	}
-
-	inv.Buyer = caller
-	inv.Status = "1"
-
-	_, err  = t.save_changes(stub, inv)
-
-	if err != nil { fmt.Printf("OFFER_TRADE: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
-
-	return nil, nil
-
-}
-
-func (t *SimpleChaincode) approve_trade(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-
-	//Args
-	//				0                 1
-	//			123443232         test_user1
-	var inv Invoice
-	var invoiceId = args[0]
-
-	var caller = args[1]
-
-	inv, err := t.retrieve_invoice(stub, invoiceId)
-
-	if  caller != inv.Payer {
-		return nil, errors.New(fmt.Sprintf("Permission Denied. approve_trade. %v !== %v", caller, inv.Payer))
-	}
-
-	inv.Status = "2"
-
-	_, err  = t.save_changes(stub, inv)
-
-	if err != nil { fmt.Printf("APPROVE_TRADE: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
-
-	return nil, nil
-
-}
-
-func (t *SimpleChaincode) reject_trade(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-
-	//Args
-	//				0                 1
-	//			123443232         test_user1
-	var inv Invoice
-	var invoiceId = args[0]
-
-	var caller = args[1]
-
-	inv, err := t.retrieve_invoice(stub, invoiceId)
-
-	if  caller != inv.Payer {
-		return nil, errors.New(fmt.Sprintf("Permission Denied. reject_trade. %v !== %v", caller, inv.Payer))
-	}
-
-	if inv.Status == "0" {
-		return nil, errors.New(fmt.Sprintf("Permission Denied. reject_trade. This invoice hasn't been bought by a third party buyer"))
-	}
-	if inv.Status == "2" {
-		return nil, errors.New(fmt.Sprintf("Permission Denied. reject_trade. This invoice has already been approved."))
-	}
-
-	inv.Status = "0"
-	inv.Buyer = "UNDEFINED"
-
-	_, err  = t.save_changes(stub, inv)
-
-	if err != nil { fmt.Printf("REJECT_TRADE: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
-
-	return nil, nil
-
-}
-
-//=================================================================================================================================
-//	 Read Functions
-//=================================================================================================================================
-//	 get_invoice_details
-//=================================================================================================================================
-func (t *SimpleChaincode) get_invoice_details(stub shim.ChaincodeStubInterface, inv Invoice, caller string) ([]byte, error) {
-
-	bytes, err := json.Marshal(inv)
-
-	if err != nil { return nil, errors.New("GET_INVOICE_DETAILS: Invalid invoice object") }
-
-	if 		inv.Supplier  == caller		||
-			inv.Buyer	== caller	||
-			inv.Payer == caller	 {
-				return bytes, nil
-	} else {
-			return nil, errors.New("Permission Denied. get_invoice_details")
-	}
-
-}
-
-//=================================================================================================================================
-//	 get_invoices
-//=================================================================================================================================
-
-func (t *SimpleChaincode) get_invoices(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	
-	bytes, err := stub.GetState("invoiceIDs")
-	if err != nil { return nil, errors.New("Unable to get invoiceIDs") }
-
-	var caller = args[0]
-
-	var invoiceIDs Invoice_Holder
-
-	err = json.Unmarshal(bytes, &invoiceIDs)
-
-	if err != nil {	return nil, errors.New("Corrupt Invoice_Holder") }
-
-	result := "["
-
-	var temp []byte
-	var inv Invoice
-
-	for _, invoiceId := range invoiceIDs.Invoices {
-
-		inv, err = t.retrieve_invoice(stub, invoiceId)
-
-		if err != nil {return nil, errors.New("Failed to retrieve Invoice")}
-
-		temp, err = t.get_invoice_details(stub, inv, caller)
-
-		if err == nil {
-			result += string(temp) + ","
-		}
-	}
-
-	if len(result) == 1 {
-		result = "[]"
-	} else {
-		result = result[:len(result)-1] + "]"
-	}
-
-	return []byte(result), nil
-}
-
-func (t *SimpleChaincode) get_opening_trade_invoices(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	bytes, err := stub.GetState("invoiceIDs")
-
-	if err != nil { return nil, errors.New("Unable to get invoiceIDs") }
-
-	var invoiceIDs Invoice_Holder
-
-	err = json.Unmarshal(bytes, &invoiceIDs)
-
-	if err != nil {	return nil, errors.New("Corrupt Invoice_Holder") }
-
-	result := "["
-
-	var inv Invoice
-
-	for _, invoiceId := range invoiceIDs.Invoices {
-
-		inv, err = t.retrieve_invoice(stub, invoiceId)
-		if err != nil {return nil, errors.New("Failed to retrieve Invoice")}
-
-		if inv.Status == "0" {
-			bytes, err := json.Marshal(inv)
-			if err != nil { return nil, errors.New("GET_INVOICE_DETAILS: Invalid invoice object") }
-			result += string(bytes) + ","
-		}
-	}
-
-	if len(result) == 1 {
-		result = "[]"
-	} else {
-		result = result[:len(result)-1] + "]"
-	}
-
-	return []byte(result), nil
-}
-
-//=================================================================================================================================
-//	 Main - main - Starts up the chaincode
-//=================================================================================================================================
-func main() {
-
-	err := shim.Start(new(SimpleChaincode))
-	if err != nil { fmt.Printf("Error starting Chaincode: %s", err) }
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"encoding/json"
+	"github.com/sreedhar310/learn-chaincode/fees"
+	"github.com/sreedhar310/learn-chaincode/idempotency"
+	"github.com/sreedhar310/learn-chaincode/builder"
+	"github.com/sreedhar310/learn-chaincode/identity"
+	"github.com/sreedhar310/learn-chaincode/ledger"
+	"github.com/sreedhar310/learn-chaincode/validate"
+)
+
+//==============================================================================================================================
+//	 Participant roles
+//==============================================================================================================================
+
+const   SUPPLIER   =  "supplier"
+const   PAYER   =  "payer"
+const   BUYER =  "buyer"
+const   ADMIN =  "admin"
+
+
+//==============================================================================================================================
+//	Structure Definitions
+//==============================================================================================================================
+//	Chaincode - A blank struct for use with Shim (A HyperLedger included go file used for get/put state
+//				and other HyperLedger functions)
+//==============================================================================================================================
+type  SimpleChaincode struct {
+}
+
+//==============================================================================================================================
+//	Invoice - Defines the structure for a invoice object. JSON on right tells it what JSON fields to map to
+//			  that element when reading a JSON object into the struct e.g. JSON amount -> Struct Amount.
+//==============================================================================================================================
+type Invoice struct {
+	InvoiceId        string `json:"invoiceid"`
+	Amount           string `json:"amount"`
+	Currency         string `json:"currency"`
+	Supplier         string `json:"supplier"`
+	Payer            string `json:"payer"`
+	DueDate          string `json:"duedate"`
+	Status           string `json:"status"`
+	Buyer            string `json:"buyer"`
+	Discount         string `json:"discount"`
+	Program          string `json:"program"`
+	KeyHash          string `json:"keyhash,omitempty"`
+
+}
+
+
+//==============================================================================================================================
+//	Invoice Holder - Defines the structure that holds all the invoiceIDs for invoices that have been created.
+//				     Used as an index when querying all invoices.
+//==============================================================================================================================
+
+type Invoice_Holder struct {
+	Invoices 	[]string `json:"invoices"`
+}
+
+
+//==============================================================================================================================
+//	Init Function - Called when the user deploys the chaincode
+//==============================================================================================================================
+func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+
+	//Args
+	//				0              1             2            3            4            5            6            7
+	//			test_user0      supplier    test_user1      payer      test_user2     buyer      admin_user     admin
+	//	a role may list several roles, e.g. supplier,payer
+
+	var invoiceIDs Invoice_Holder
+
+	bytes, err := json.Marshal(invoiceIDs)
+
+    if err != nil { return nil, errors.New("Error creating Invoice_Holder record") }
+
+	err = stub.PutState("invoiceIDs", bytes)
+	if err != nil { return nil, errors.New("Error putting state with invoiceIDs") }
+
+	if len(args) % 2 != 0 { return nil, errors.New("Incorrect number of arguments. Expecting pairs of user and role") }
+
+	// save the role of users in the world state  (LATER, MAY USE TCERT ATTRIBUTES)
+	for i:=0; i < len(args); i=i+2 {
+		_, err = t.add_particants(stub, args[i], args[i+1])
+		if err != nil { return nil, err }
+	}
+
+	return nil, nil
+}
+
+//==============================================================================================================================
+//	 General Functions: add_particants
+//==============================================================================================================================
+
+func (t *SimpleChaincode) add_particants(stub shim.ChaincodeStubInterface, name string, role string) ([]byte, error) {
+
+	roles, err := parse_roles(role)
+
+	if err != nil { return nil, err }
+
+	err = t.save_participant(stub, Participant{Name: name, DisplayName: name, Roles: roles, KYCStatus: KYC_PENDING, Status: ACTIVE}, "init", "register")
+
+	if err != nil {
+		return nil, errors.New("Error storing user " + name + " role: " + role)
+	}
+
+	return nil, nil
+
+}
+
+//==============================================================================================================================
+//	 retrieve_invoice - Returns the invoice, decrypted if it is confidential. Without the invoice key the sealed invoice
+//						is returned along with ERR_INVOICE_SEALED.
+//==============================================================================================================================
+func (t *SimpleChaincode) retrieve_invoice(stub shim.ChaincodeStubInterface, invoiceId string) (Invoice, error) {
+
+	var inv Invoice
+
+	bytes, err := stub.GetState(invoiceId);
+
+	if err != nil { return inv, errors.New("RETRIEVE_INVOICE: Error retrieving invoice with invoice Id = " + invoiceId) }
+
+	err = json.Unmarshal(bytes, &inv);
+
+    if err != nil { return inv, errors.New("RETRIEVE_INVOICE: Corrupt invoice record "+string(bytes))	}
+
+	return t.open_invoice(stub, inv)
+}
+
+//==============================================================================================================================
+// save_changes - Writes to the ledger the Vehicle struct passed in a JSON format. Uses the shim file's
+//				  method 'PutState'.
+//==============================================================================================================================
+func (t *SimpleChaincode) save_changes(stub shim.ChaincodeStubInterface, inv Invoice) (bool, error) {
+
+	inv, err := t.seal_invoice(stub, inv)									// Confidential fields are only ever stored encrypted
+
+	if err != nil { return false, err }
+
+	bytes, err := json.Marshal(inv)
+
+	if err != nil { return false, errors.New("Error converting invoice record") }
+
+	err = stub.PutState(inv.InvoiceId, bytes)
+
+	if err != nil { return false, errors.New("Error storing invoice record") }
+
+	return true, nil
+}
+
+//==============================================================================================================================
+//	 Router Functions
+//==============================================================================================================================
+//	Invoke - Called on chaincode invoke. Takes a function name passed and calls that function once the caller has
+//		  been checked against the function's access policy. The caller is taken from the transaction certificate
+//		  and passed on to the called function.
+//==============================================================================================================================
+func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+
+	caller, err := identity.Caller(stub)
+
+	if err != nil { return nil, errors.New("Error retrieving caller information: " + err.Error()) }
+
+	err = t.authorize(stub, function, caller, args)
+
+	if err != nil { return nil, err }
+
+	if function == "create_invoice" {
+        return t.create_invoice(stub, caller, args)
+	} else if function == "approve_trade"{
+		return idempotency.Run(stub, caller, function, args, func() ([]byte, error) { return t.approve_trade(stub, caller, args) })
+	} else if function == "reject_trade"{
+		return idempotency.Run(stub, caller, function, args, func() ([]byte, error) { return t.reject_trade(stub, caller, args) })
+	} else if function == "accept_trade"{
+		return idempotency.Run(stub, caller, function, args, func() ([]byte, error) { return t.accept_trade(stub, caller, args) })
+	} else if function == "expire_trade"{
+		return idempotency.Run(stub, caller, function, args, func() ([]byte, error) { return t.expire_trade(stub, args) })
+	} else if function == "init_account"{
+		return t.init_account(stub, caller, args)
+	} else if function == "fund_account"{
+		return idempotency.Run(stub, caller, function, args, func() ([]byte, error) { return t.fund_account(stub, caller, args) })
+	} else if function == "register_participant"{
+		return t.register_participant(stub, caller, args)
+	} else if function == "update_participant_roles"{
+		return t.update_participant_roles(stub, caller, args)
+	} else if function == "update_participant_details"{
+		return t.update_participant_details(stub, caller, args)
+	} else if function == "update_participant_kyc"{
+		return t.update_participant_kyc(stub, caller, args)
+	} else if function == "suspend_participant"{
+		return t.set_participant_status(stub, caller, args, SUSPENDED, "suspend_participant")
+	} else if function == "reinstate_participant"{
+		return t.set_participant_status(stub, caller, args, ACTIVE, "reinstate_participant")
+	} else if function == "set_approval_policy"{
+		return t.set_approval_policy(stub, caller, args)
+	} else if function == "create_program"{
+		return t.create_program(stub, caller, args)
+	} else if function == "add_program_supplier"{
+		return t.add_program_member(stub, caller, args, SUPPLIER)
+	} else if function == "add_program_funder"{
+		return t.add_program_member(stub, caller, args, BUYER)
+	} else if function == "approve_invoice_for_program"{
+		return t.approve_invoice_for_program(stub, caller, args)
+	} else if function == "request_early_payment"{
+		return idempotency.Run(stub, caller, function, args, func() ([]byte, error) { return t.request_early_payment(stub, caller, args) })
+	} else if function == "fund_early_payment"{
+		return idempotency.Run(stub, caller, function, args, func() ([]byte, error) { return t.fund_early_payment(stub, caller, args) })
+	} else if function == "set_fee_rule"{
+		return t.set_fee_rule(stub, caller, args)
+	} else if function == "remove_fee_rule"{
+		return t.remove_fee_rule(stub, caller, args)
+	} else if function == "set_fee_account"{
+		return t.set_fee_account(stub, caller, args)
+	} else if function == "register_obligation"{
+		return t.register_obligation(stub, caller, args)
+	} else if function == "register_invoice_obligation"{
+		return t.register_invoice_obligation(stub, caller, args)
+	} else if function == "cancel_obligation"{
+		return t.cancel_obligation(stub, caller, args)
+	} else if function == "run_netting_cycle"{
+		return idempotency.Run(stub, caller, function, args, func() ([]byte, error) { return t.run_netting_cycle(stub, caller, args) })
+	}
+
+    return nil, errors.New("Received unknown function invocation: " + function)
+}
+//=================================================================================================================================
+//	Query - Called on chaincode query. Takes a function name passed and calls that function once the caller has
+//  		been checked against the function's access policy. The arguments are passed on to the called function.
+//=================================================================================================================================
+func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+
+	caller, err := identity.Caller(stub)
+
+	if err != nil { return nil, errors.New("QUERY: Error retrieving caller details: " + err.Error()) }
+
+	err = t.authorize(stub, function, caller, args)
+
+	if err != nil { return nil, errors.New("QUERY: " + err.Error()) }
+
+	if function == "get_invoice_details" {
+		err = identity.CheckArgs(args, 1)
+		if err != nil { return nil, errors.New("QUERY: " + err.Error()) }
+		inv, err := t.retrieve_invoice(stub, args[0])
+		if err != nil { return nil, errors.New("QUERY: Error retrieving invoice "+err.Error()) }
+		return t.get_invoice_details(stub, inv, caller)
+	}  else if function == "get_invoices" {
+		return t.get_invoices(stub, caller, args)
+	}  else if function == "get_opening_trade_invoices" {
+		return t.get_opening_trade_invoices(stub, args)
+	}  else if function == "get_escrow" {
+		return t.get_escrow(stub, caller, args)
+	}  else if function == "get_buyer_escrows" {
+		return t.get_buyer_escrows(stub, caller, args)
+	}  else if function == "list_participants" {
+		return t.list_participants(stub, caller, args)
+	}  else if function == "get_participant" {
+		return t.get_participant(stub, caller, args)
+	}  else if function == "get_participant_audit" {
+		return t.get_participant_audit(stub, caller, args)
+	}  else if function == "get_approval_policy" {
+		return t.get_approval_policy(stub, args)
+	}  else if function == "get_approvals" {
+		return t.get_approvals(stub, caller, args)
+	}  else if function == "get_program" {
+		return t.get_program(stub, caller, args)
+	}  else if function == "get_trial_balance" {
+		return ledger.GetTrialBalance(stub)
+	}  else if function == "get_fee_schedule" {
+		return t.get_fee_schedule(stub)
+	}  else if function == "get_fee_report" {
+		return fees.GetReport(stub)
+	}  else if function == "get_obligations" {
+		return t.get_obligations(stub, caller, args)
+	}  else if function == "get_netting_cycle" {
+		return t.get_netting_cycle(stub, caller, args)
+	}  else if function == "get_invoice_schema" {
+		return []byte(validate.InvoiceSchema), nil
+	}  else if function == "read" {											
+		return t.read(stub, args)
+	}  else if function == "get_username" {			
+		return []byte(caller), nil
+	}  else if function == "get_permissions" {
+		return t.get_permissions(stub, caller, args)
+	} 
+
+	return nil, errors.New("Received unknown function query " + function)
+
+}
+
+
+func (t *SimpleChaincode) read(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var name, jsonResp string
+	var err error
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting name of the var to query")
+	}
+
+	name = args[0]
+
+	if strings.Contains(name, ":") {											// Escrows, obligations, ledger entries etc. can reveal a confidential invoice
+		return nil, errors.New("Permission Denied. read. " + name + " is only available through its own query")
+	}
+
+	valAsbytes, err := stub.GetState(name)									//get the var from chaincode state
+	if err != nil {
+		jsonResp = "{\"Error\":\"Failed to get state for " + name + "\"}"
+		return nil, errors.New(jsonResp)
+	}
+
+	return valAsbytes, nil													//send it onward
+}
+
+//==============================================================================================================================
+//	 build_invoice - Returns the invoice once every field is valid and the payer is registered in that role. The supplier
+//					 is the caller, whose role the create_invoice policy has already checked.
+//==============================================================================================================================
+func (t *SimpleChaincode) build_invoice(stub shim.ChaincodeStubInterface, b *builder.Invoice) (Invoice, error) {
+
+	var inv Invoice
+
+	f, err := b.Build()
+	if err != nil { return inv, err }
+
+	err = t.check_role(stub, f.Payer, PAYER, "create_invoice")
+	if err != nil { return inv, err }
+
+	inv = Invoice{InvoiceId: f.InvoiceId, Amount: f.Amount, Currency: f.Currency, Supplier: f.Supplier, Payer: f.Payer,
+		DueDate: f.DueDate, Status: "0", Buyer: builder.Undefined, Discount: f.Discount}
+
+	return inv, nil
+}
+
+//=================================================================================================================================
+//	 Create Function
+//=================================================================================================================================
+//	 Create Invoice - Creates the initial JSON for the invoice and then saves it to the ledger.
+//=================================================================================================================================
+func (t *SimpleChaincode) create_invoice(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//Args
+	//				0               1              2              3
+	//			123443232        100.00           0.05        test_user1
+	//	or a single JSON payload matching the schema returned by get_invoice_schema. The supplier is always the caller.
+	//				0
+	//			{"invoiceid":"123443232","amount":"100.00","currency":"EUR","payer":"test_user1"}
+
+	b := builder.NewInvoice()
+
+	if len(args) == 1 {
+		b.Payload(args[0])
+		if b.Fields().Supplier != "" && b.Fields().Supplier != caller {
+			return nil, errors.New(fmt.Sprintf("Permission Denied. create_invoice. %v !== %v", b.Fields().Supplier, caller))
+		}
+		b.Supplier(caller)
+	} else if len(args) == 4 {
+		b.ID(args[0]).Amount(args[1]).Discount(args[2]).Supplier(caller).Payer(args[3])
+	} else if len(args) == 5 {
+		return nil, identity.CheckArgs(args, 4)
+	} else {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4 or a JSON payload")
+	}
+
+	inv, err := t.build_invoice(stub, b)
+
+	if err != nil { return nil, err }
+
+	key, err := t.get_invoice_key(stub)											// A key in the metadata makes the invoice confidential
+
+	if err != nil { return nil, err }
+
+	if key != nil { inv.KeyHash = key_hash(key) }
+
+	var invoiceId = inv.InvoiceId
+
+	record, err := stub.GetState(inv.InvoiceId) 								// If not an error then a record exists so cant create a new invoice with this ID as it must be unique
+
+	if record != nil { return nil, errors.New("Invoice already exists") }
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("CREATE_INVOICE: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+
+	bytes, err := stub.GetState("invoiceIDs")
+
+	if err != nil { return nil, errors.New("Unable to get invoiceIDs") }
+
+	var invoiceIDs Invoice_Holder
+
+	err = json.Unmarshal(bytes, &invoiceIDs)
+
+	if err != nil {	return nil, errors.New("Corrupt Invoice_Holder record") }
+
+	invoiceIDs.Invoices = append(invoiceIDs.Invoices, invoiceId)
+
+	bytes, err = json.Marshal(invoiceIDs)
+
+	if err != nil { fmt.Print("Error creating Invoice_Holder record") }
+
+	err = stub.PutState("invoiceIDs", bytes)
+
+	if err != nil { return nil, errors.New("Unable to put the state") }
+
+	return nil, nil
+
+}
+
+
+
+func (t *SimpleChaincode) accept_trade(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//Args
+	//				0
+	//			123443232
+	var inv Invoice
+
+	err := identity.CheckArgs(args, 1)
+
+	if err != nil { return nil, err }
+
+	var invoiceId = args[0]
+
+	inv, err = t.retrieve_invoice(stub, invoiceId)
+
+	if err != nil { return nil, err }
+
+	if inv.Status != "0" || inv.Program != "" {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. accept_trade. This invoice isn't open for trade"))
+	}
+
+	price, err := purchase_price(inv, inv.Discount)
+
+	if err != nil { return nil, err }
+
+	err = t.lock_escrow(stub, inv, caller, price)											// Reserve the purchase price before the buyer is recorded
+
+	if err != nil { fmt.Printf("ACCEPT_TRADE: Error locking escrow: %s", err); return nil, errors.New("Error locking escrow: " + err.Error()) }
+
+	err = t.collect_fee(stub, "accept_trade", caller, inv.Currency, price)						// The buyer pays the fee on top of the purchase price
+
+	if err != nil { return nil, err }
+
+	inv.Buyer = caller
+	inv.Status = "1"
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("OFFER_TRADE: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+
+	return nil, nil
+
+}
+
+func (t *SimpleChaincode) approve_trade(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//Args
+	//				0
+	//			123443232
+	var inv Invoice
+
+	err := identity.CheckArgs(args, 1)
+
+	if err != nil { return nil, err }
+
+	var invoiceId = args[0]
+
+	inv, err = t.retrieve_invoice(stub, invoiceId)
+
+	if err != nil { return nil, err }
+
+	if inv.Status != "1" {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. approve_trade. This invoice hasn't been bought by a third party buyer"))
+	}
+
+	complete, err := t.record_approval(stub, inv, caller, "approve_trade", APPROVE_TRADE, inv.Buyer)										// The payer's policy may need more than one signatory
+
+	if err != nil { return nil, err }
+
+	if !complete { return nil, nil }
+
+	err = t.settle_escrow(stub, invoiceId, inv.Buyer, ESCROW_RELEASED)										// Pay the supplier from the buyer's escrow
+
+	if err != nil { fmt.Printf("APPROVE_TRADE: Error releasing escrow: %s", err); return nil, errors.New("Error releasing escrow: " + err.Error()) }
+
+	inv.Status = "2"
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("APPROVE_TRADE: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+
+	return nil, nil
+
+}
+
+func (t *SimpleChaincode) reject_trade(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//Args
+	//				0
+	//			123443232
+	var inv Invoice
+
+	err := identity.CheckArgs(args, 1)
+
+	if err != nil { return nil, err }
+
+	var invoiceId = args[0]
+
+	inv, err = t.retrieve_invoice(stub, invoiceId)
+
+	if err != nil { return nil, err }
+
+	signatory, err := t.is_payer_signatory(stub, inv, caller)
+
+	if err != nil { return nil, err }
+
+	if  !signatory {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. reject_trade. %v !== %v", caller, inv.Payer))
+	}
+
+	if inv.Status == "0" {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. reject_trade. This invoice hasn't been bought by a third party buyer"))
+	}
+	if inv.Status == "2" {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. reject_trade. This invoice has already been approved."))
+	}
+
+	err = t.settle_escrow(stub, invoiceId, inv.Buyer, ESCROW_REFUNDED)										// Give the buyer their money back
+
+	if err != nil { fmt.Printf("REJECT_TRADE: Error refunding escrow: %s", err); return nil, errors.New("Error refunding escrow: " + err.Error()) }
+
+	err = t.clear_approvals(stub, invoiceId, APPROVE_TRADE, inv.Buyer)
+
+	if err != nil { return nil, err }
+
+	inv.Status = "0"
+	inv.Buyer = "UNDEFINED"
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("REJECT_TRADE: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 Read Functions
+//=================================================================================================================================
+//	 get_invoice_details
+//=================================================================================================================================
+func (t *SimpleChaincode) get_invoice_details(stub shim.ChaincodeStubInterface, inv Invoice, caller string) ([]byte, error) {
+
+	bytes, err := json.Marshal(inv)
+
+	if err != nil { return nil, errors.New("GET_INVOICE_DETAILS: Invalid invoice object") }
+
+	if 		inv.Supplier  == caller		||
+			inv.Buyer	== caller	||
+			inv.Payer == caller	 {
+				return bytes, nil
+	} else {
+			return nil, errors.New("Permission Denied. get_invoice_details")
+	}
+
+}
+
+//=================================================================================================================================
+//	 get_invoices
+//=================================================================================================================================
+
+func (t *SimpleChaincode) get_invoices(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+	
+	bytes, err := stub.GetState("invoiceIDs")
+	if err != nil { return nil, errors.New("Unable to get invoiceIDs") }
+
+	err = identity.CheckArgs(args, 0)
+
+	if err != nil { return nil, err }
+
+	var invoiceIDs Invoice_Holder
+
+	err = json.Unmarshal(bytes, &invoiceIDs)
+
+	if err != nil {	return nil, errors.New("Corrupt Invoice_Holder") }
+
+	result := "["
+
+	var temp []byte
+	var inv Invoice
+
+	for _, invoiceId := range invoiceIDs.Invoices {
+
+		inv, err = t.retrieve_invoice(stub, invoiceId)
+
+		if err == ERR_INVOICE_SEALED { continue }								// Only invoices the caller holds the key for
+
+		if err != nil {return nil, errors.New("Failed to retrieve Invoice")}
+
+		temp, err = t.get_invoice_details(stub, inv, caller)
+
+		if err == nil {
+			result += string(temp) + ","
+		}
+	}
+
+	if len(result) == 1 {
+		result = "[]"
+	} else {
+		result = result[:len(result)-1] + "]"
+	}
+
+	return []byte(result), nil
+}
+
+func (t *SimpleChaincode) get_opening_trade_invoices(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	bytes, err := stub.GetState("invoiceIDs")
+
+	if err != nil { return nil, errors.New("Unable to get invoiceIDs") }
+
+	var invoiceIDs Invoice_Holder
+
+	err = json.Unmarshal(bytes, &invoiceIDs)
+
+	if err != nil {	return nil, errors.New("Corrupt Invoice_Holder") }
+
+	result := "["
+
+	var inv Invoice
+
+	for _, invoiceId := range invoiceIDs.Invoices {
+
+		inv, err = t.retrieve_invoice(stub, invoiceId)
+		if err != nil && err != ERR_INVOICE_SEALED {return nil, errors.New("Failed to retrieve Invoice")}	// Confidential invoices are listed sealed
+
+		if inv.Status == "0" && inv.Program == "" {
+			bytes, err := json.Marshal(inv)
+			if err != nil { return nil, errors.New("GET_INVOICE_DETAILS: Invalid invoice object") }
+			result += string(bytes) + ","
+		}
+	}
+
+	if len(result) == 1 {
+		result = "[]"
+	} else {
+		result = result[:len(result)-1] + "]"
+	}
+
+	return []byte(result), nil
+}
+
+//=================================================================================================================================
+//	 Main - main - Starts up the chaincode
+//=================================================================================================================================
+func main() {
+
+	err := shim.Start(new(SimpleChaincode))
+	if err != nil { fmt.Printf("Error starting Chaincode: %s", err) }
 }
\ No newline at end of file
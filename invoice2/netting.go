@@ -0,0 +1,569 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sreedhar310/learn-chaincode/identity"
+	"github.com/sreedhar310/learn-chaincode/ledger"
+	"github.com/sreedhar310/learn-chaincode/validate"
+)
+
+//==============================================================================================================================
+//	 Obligation states
+//==============================================================================================================================
+
+const   OBLIGATION_PENDING  =  "pending"
+const   OBLIGATION_SETTLED  =  "settled"
+const   OBLIGATION_CANCELLED =  "cancelled"
+
+const   obligationIndexStr  =  "index:obligations"		// IDs of the obligations waiting for the next netting cycle
+const   cycleIndexStr       =  "index:nettingcycles"		// IDs of every netting cycle run, in order
+
+//==============================================================================================================================
+//	Obligation - An amount one participant owes another, registered to be settled by netting rather than paid on its
+//				 own. Amounts are held in cents so that netting many small amounts doesn't drift.
+//==============================================================================================================================
+type Obligation struct {
+	ObligationId     string `json:"obligationid"`
+	Debtor           string `json:"debtor"`
+	Creditor         string `json:"creditor"`
+	Amount           string `json:"amount"`
+	Currency         string `json:"currency"`
+	Reference        string `json:"reference"`
+	Status           string `json:"status"`
+	RegisteredBy     string `json:"registeredby"`
+	Registered       int64  `json:"registered"`
+	Cycle            string `json:"cycle,omitempty"`
+	CancelledBy      string `json:"cancelledby,omitempty"`
+}
+
+//==============================================================================================================================
+//	Net_Position - What a participant owes and is owed in one currency over a cycle, and the difference that is settled
+//==============================================================================================================================
+type Net_Position struct {
+	Participant      string `json:"participant"`
+	Currency         string `json:"currency"`
+	Owes             string `json:"owes"`
+	Owed             string `json:"owed"`
+	Net              string `json:"net"`
+}
+
+//==============================================================================================================================
+//	Netting_Cycle - The report of a netting cycle, kept for audit. Obligations are the ones settled, Deferred those
+//					left for the next cycle because a participant in them couldn't settle, e.g. a net debtor short of
+//					funds, and Shortfalls say why. A cycle that settled nothing is stored too.
+//==============================================================================================================================
+type Netting_Cycle struct {
+	CycleId          string            `json:"cycleid"`
+	RunBy            string            `json:"runby"`
+	Timestamp        int64             `json:"timestamp"`
+	Settled          bool              `json:"settled"`
+	Obligations      []string          `json:"obligations"`
+	Deferred         []string          `json:"deferred,omitempty"`
+	Positions        []Net_Position    `json:"positions"`
+	Gross            map[string]string `json:"gross"`
+	Settlement       map[string]string `json:"settlement"`
+	Shortfalls       []string          `json:"shortfalls,omitempty"`
+}
+
+func obligation_key(id string) string { return "obligation:" + id }
+func participant_obligations_key(name string) string { return "obligations:" + name }
+func cycle_key(id string) string { return "netting:" + id }
+
+func to_cents(amount float64) int64 { return int64(math.Floor(amount * 100 + 0.5)) }
+func from_cents(cents int64) string { return strconv.FormatFloat(float64(cents) / 100, 'f', 2, 64) }
+
+//==============================================================================================================================
+//	 load_ids / save_ids - Read and write a JSON list of IDs, empty if the key isn't set
+//==============================================================================================================================
+func (t *SimpleChaincode) load_ids(stub shim.ChaincodeStubInterface, key string) ([]string, error) {
+
+	var ids []string
+
+	bytes, err := stub.GetState(key)
+	if err != nil { return nil, errors.New("Unable to get " + key) }
+	if bytes == nil { return ids, nil }
+
+	err = json.Unmarshal(bytes, &ids)
+	if err != nil { return nil, errors.New("Corrupt list " + key) }
+
+	return ids, nil
+}
+
+func (t *SimpleChaincode) save_ids(stub shim.ChaincodeStubInterface, key string, ids []string) error {
+
+	bytes, err := json.Marshal(ids)
+	if err != nil { return errors.New("Error converting list " + key) }
+
+	return stub.PutState(key, bytes)
+}
+
+func (t *SimpleChaincode) retrieve_obligation(stub shim.ChaincodeStubInterface, id string) (Obligation, bool, error) {
+
+	var ob Obligation
+
+	bytes, err := stub.GetState(obligation_key(id))
+	if err != nil { return ob, false, errors.New("RETRIEVE_OBLIGATION: Error retrieving obligation " + id) }
+	if bytes == nil { return ob, false, nil }
+
+	err = json.Unmarshal(bytes, &ob)
+	if err != nil { return ob, false, errors.New("RETRIEVE_OBLIGATION: Corrupt obligation record " + string(bytes)) }
+
+	return ob, true, nil
+}
+
+func (t *SimpleChaincode) save_obligation(stub shim.ChaincodeStubInterface, ob Obligation) error {
+
+	bytes, err := json.Marshal(ob)
+	if err != nil { return errors.New("Error converting obligation record") }
+
+	err = stub.PutState(obligation_key(ob.ObligationId), bytes)
+	if err != nil { return errors.New("Error storing obligation record") }
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 add_obligation - Checks and stores a new obligation, and adds it to the pending index and both parties' lists
+//==============================================================================================================================
+func (t *SimpleChaincode) add_obligation(stub shim.ChaincodeStubInterface, ob Obligation) error {
+
+	if ob.Debtor == ob.Creditor { return errors.New("A participant can't owe itself") }
+
+	for _, name := range []string{ob.Debtor, ob.Creditor} {
+		p, found, err := t.retrieve_participant(stub, name)
+		if err != nil { return err }
+		if !found || p.Status != ACTIVE { return errors.New(name + " isn't an active participant") }
+	}
+
+	acc, err := t.retrieve_account(stub, ob.Debtor, "", false)
+	if err != nil { return err }
+	if acc.Currency != ob.Currency {
+		return errors.New(fmt.Sprintf("Account %v is held in %v, not %v", ob.Debtor, acc.Currency, ob.Currency))
+	}
+
+	_, found, err := t.retrieve_obligation(stub, ob.ObligationId)
+	if err != nil { return err }
+	if found { return errors.New("Obligation already registered: " + ob.ObligationId) }
+
+	now, err := t.get_tx_time(stub)
+	if err != nil { return err }
+
+	ob.Status = OBLIGATION_PENDING
+	ob.Registered = now
+
+	err = t.save_obligation(stub, ob)
+	if err != nil { return err }
+
+	for _, key := range []string{obligationIndexStr, participant_obligations_key(ob.Debtor), participant_obligations_key(ob.Creditor)} {
+		ids, err := t.load_ids(stub, key)
+		if err != nil { return err }
+		err = t.save_ids(stub, key, append(ids, ob.ObligationId))
+		if err != nil { return err }
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 register_obligation - Records an amount the caller owes another participant, to be settled by the next netting
+//						   cycle. Only the debtor can register a debt.
+//==============================================================================================================================
+func (t *SimpleChaincode) register_obligation(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//Args
+	//				0           1        2          3
+	//			test_user2    125.50    USD    delivery 4411
+
+	err := identity.CheckArgs(args, 4)
+	if err != nil { return nil, err }
+
+	amount, err := validate.Money(args[1])
+	if err != nil { return nil, errors.New("Amount must be a positive amount with at most two decimal places") }
+
+	ob := Obligation{
+		ObligationId: stub.GetTxID(),
+		Debtor:       caller,
+		Creditor:     args[0],
+		Amount:       from_cents(to_cents(amount)),
+		Currency:     args[2],
+		Reference:    args[3],
+		RegisteredBy: caller,
+	}
+
+	err = t.add_obligation(stub, ob)
+	if err != nil { return nil, err }
+
+	return []byte(ob.ObligationId), nil
+}
+
+//==============================================================================================================================
+//	 register_invoice_obligation - Records that the payer of a traded invoice owes its buyer the invoice amount, once
+//								   the invoice has matured. Either of them can register it, and only once per invoice.
+//==============================================================================================================================
+func (t *SimpleChaincode) register_invoice_obligation(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//Args
+	//				0
+	//			123443232
+
+	err := identity.CheckArgs(args, 1)
+	if err != nil { return nil, err }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return nil, err }
+
+	if inv.Status != "2" { return nil, errors.New("Only an invoice that has been bought and approved can be netted") }
+
+	due, err := time.Parse("2006-01-02", inv.DueDate)
+	if err != nil { return nil, errors.New("Invoice " + inv.InvoiceId + " has no due date") }
+
+	now, err := t.get_tx_time(stub)
+	if err != nil { return nil, err }
+
+	if now < due.Unix() {
+		return nil, errors.New(fmt.Sprintf("Invoice %v doesn't mature until %v", inv.InvoiceId, inv.DueDate))
+	}
+
+	amount, err := strconv.ParseFloat(inv.Amount, 64)
+	if err != nil { return nil, errors.New("Invoice amount is not numeric: " + inv.Amount) }
+
+	ob := Obligation{
+		ObligationId: "invoice-" + inv.InvoiceId,
+		Debtor:       inv.Payer,
+		Creditor:     inv.Buyer,
+		Amount:       from_cents(to_cents(amount)),
+		Currency:     inv.Currency,
+		Reference:    "invoice " + inv.InvoiceId,
+		RegisteredBy: caller,
+	}
+
+	err = t.add_obligation(stub, ob)
+	if err != nil { return nil, err }
+
+	return []byte(ob.ObligationId), nil
+}
+
+//==============================================================================================================================
+//	 net_obligations - Sums the cents each participant owes and is owed over some obligations, and their gross total
+//==============================================================================================================================
+func net_obligations(obligations []Obligation) (map[string]int64, map[string]int64, int64, error) {
+
+	owes := map[string]int64{}
+	owed := map[string]int64{}
+	gross := int64(0)
+
+	for _, ob := range obligations {
+		amount, err := strconv.ParseFloat(ob.Amount, 64)
+		if err != nil { return nil, nil, 0, errors.New("Obligation amount is not numeric: " + ob.Amount) }
+		cents := to_cents(amount)
+
+		owes[ob.Debtor] += cents
+		owed[ob.Creditor] += cents
+		gross += cents
+	}
+
+	return owes, owed, gross, nil
+}
+
+//==============================================================================================================================
+//	 net_participants - Everyone who owes or is owed anything, in order
+//==============================================================================================================================
+func net_participants(owes map[string]int64, owed map[string]int64) []string {
+
+	var names []string
+	for name := range owes { names = append(names, name) }
+	for name := range owed {
+		if _, ok := owes[name]; !ok { names = append(names, name) }
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+//==============================================================================================================================
+//	 shortfall - Why a participant's net position in a currency can't be settled, or "" if it can. A net creditor only
+//				 needs somewhere to be paid, a net debtor needs the funds as well.
+//==============================================================================================================================
+func (t *SimpleChaincode) shortfall(stub shim.ChaincodeStubInterface, name string, currency string, net int64) (string, error) {
+
+	acc, accErr := t.retrieve_account(stub, name, currency, net > 0)
+	if net > 0 {
+		if accErr != nil { return "", accErr }
+		if acc.Currency != currency { return "has an account in " + acc.Currency, nil }
+		return "", nil
+	}
+
+	p, found, err := t.retrieve_participant(stub, name)
+	if err != nil { return "", err }
+	if !found || p.Status != ACTIVE { return "isn't an active participant", nil }
+	if accErr != nil { return "has no account", nil }
+	if acc.Currency != currency { return "has an account in " + acc.Currency, nil }
+
+	balance, err := strconv.ParseFloat(acc.Balance, 64)
+	if err != nil || to_cents(balance) < -net { return "can't cover a net debt of " + from_cents(-net) + " " + currency, nil }
+
+	return "", nil
+}
+
+//==============================================================================================================================
+//	 run_netting_cycle - Nets the pending obligations into one position per participant and currency, and settles only
+//						 the net amounts through the account balances. A participant who can't settle, e.g. a net
+//						 debtor short of funds, is left out of the cycle: their obligations are deferred to the next
+//						 one and the rest are netted again without them, as that changes everyone else's position.
+//						 The report is stored either way. Admins only.
+//==============================================================================================================================
+func (t *SimpleChaincode) run_netting_cycle(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	err := identity.CheckArgs(args, 0)
+	if err != nil { return nil, err }
+
+	pending, err := t.load_ids(stub, obligationIndexStr)
+	if err != nil { return nil, err }
+	if len(pending) == 0 { return nil, errors.New("There are no pending obligations to net") }
+
+	now, err := t.get_tx_time(stub)
+	if err != nil { return nil, err }
+
+	cycle := Netting_Cycle{CycleId: stub.GetTxID(), RunBy: caller, Timestamp: now, Obligations: []string{}, Gross: map[string]string{}, Settlement: map[string]string{}}
+
+	byCurrency := map[string][]Obligation{}
+
+	for _, id := range pending {
+		ob, found, err := t.retrieve_obligation(stub, id)
+		if err != nil { return nil, err }
+		if !found { return nil, errors.New("Obligation in the index but not stored: " + id) }
+
+		byCurrency[ob.Currency] = append(byCurrency[ob.Currency], ob)
+	}
+
+	var currencies []string
+	for currency := range byCurrency { currencies = append(currencies, currency) }
+	sort.Strings(currencies)
+
+	var settled []Obligation
+	deferred := map[string]bool{}
+
+	for _, currency := range currencies {
+		included := byCurrency[currency]
+
+		for {
+			owes, owed, _, err := net_obligations(included)
+			if err != nil { return nil, err }
+
+			dropped := map[string]bool{}
+			for _, name := range net_participants(owes, owed) {
+				net := owed[name] - owes[name]
+				if net == 0 { continue }
+
+				reason, err := t.shortfall(stub, name, currency, net)
+				if err != nil { return nil, err }
+				if reason != "" {
+					dropped[name] = true
+					cycle.Shortfalls = append(cycle.Shortfalls, name + " " + reason)
+				}
+			}
+			if len(dropped) == 0 { break }
+
+			var kept []Obligation
+			for _, ob := range included {
+				if dropped[ob.Debtor] || dropped[ob.Creditor] {
+					deferred[ob.ObligationId] = true
+				} else {
+					kept = append(kept, ob)
+				}
+			}
+			included = kept
+		}
+		if len(included) == 0 { continue }
+
+		owes, owed, gross, err := net_obligations(included)
+		if err != nil { return nil, err }
+
+		settlement := int64(0)
+		for _, name := range net_participants(owes, owed) {
+			net := owed[name] - owes[name]
+			cycle.Positions = append(cycle.Positions, Net_Position{
+				Participant: name,
+				Currency:    currency,
+				Owes:        from_cents(owes[name]),
+				Owed:        from_cents(owed[name]),
+				Net:         from_cents(net),
+			})
+			if net < 0 { settlement -= net }
+		}
+
+		cycle.Gross[currency] = from_cents(gross)
+		cycle.Settlement[currency] = from_cents(settlement)
+		settled = append(settled, included...)
+	}
+
+	cycle.Settled = len(settled) > 0
+
+	for _, pos := range cycle.Positions {
+		net, _ := strconv.ParseFloat(pos.Net, 64)
+		if net == 0 { continue }
+
+		err = t.adjust_balance(stub, pos.Participant, pos.Currency, net)
+		if err != nil { return nil, err }
+	}
+
+	for _, currency := range currencies {
+		var lines []ledger.Line
+		for _, pos := range cycle.Positions {
+			if pos.Currency != currency { continue }
+			net, _ := strconv.ParseFloat(pos.Net, 64)
+			if net < 0 { lines = append(lines, ledger.Debit(ledger.Customer(pos.Participant), currency, -net)) }
+			if net > 0 { lines = append(lines, ledger.Credit(ledger.Customer(pos.Participant), currency, net)) }
+		}
+		if len(lines) == 0 { continue }
+
+		err = ledger.Post(stub, "netting cycle " + cycle.CycleId, lines...)
+		if err != nil { return nil, err }
+	}
+
+	for _, ob := range settled {
+		ob.Status = OBLIGATION_SETTLED
+		ob.Cycle = cycle.CycleId
+
+		err = t.save_obligation(stub, ob)
+		if err != nil { return nil, err }
+
+		cycle.Obligations = append(cycle.Obligations, ob.ObligationId)
+	}
+
+	remaining := []string{}															// Deferred obligations keep their place in the queue
+	for _, id := range pending {
+		if deferred[id] { remaining = append(remaining, id) }
+	}
+	if len(remaining) > 0 { cycle.Deferred = remaining }
+
+	err = t.save_ids(stub, obligationIndexStr, remaining)
+	if err != nil { return nil, err }
+
+	bytes, err := json.Marshal(cycle)
+	if err != nil { return nil, errors.New("Error converting netting cycle report") }
+
+	err = stub.PutState(cycle_key(cycle.CycleId), bytes)
+	if err != nil { return nil, errors.New("Error storing netting cycle report") }
+
+	cycles, err := t.load_ids(stub, cycleIndexStr)
+	if err != nil { return nil, err }
+
+	err = t.save_ids(stub, cycleIndexStr, append(cycles, cycle.CycleId))
+	if err != nil { return nil, err }
+
+	return bytes, nil
+}
+
+//==============================================================================================================================
+//	 cancel_obligation - Takes a pending obligation out of netting for good, e.g. one whose debtor will never be able to
+//						 settle. The creditor is giving up what it is owed, so only the creditor or an admin can cancel.
+//==============================================================================================================================
+func (t *SimpleChaincode) cancel_obligation(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//Args
+	//				0
+	//			obligationId
+
+	err := identity.CheckArgs(args, 1)
+	if err != nil { return nil, err }
+
+	ob, found, err := t.retrieve_obligation(stub, args[0])
+	if err != nil { return nil, err }
+	if !found { return nil, errors.New("No such obligation: " + args[0]) }
+
+	if ob.Creditor != caller {
+		err = t.check_admin(stub, caller, "cancel_obligation")
+		if err != nil { return nil, err }
+	}
+	if ob.Status != OBLIGATION_PENDING { return nil, errors.New("Obligation " + ob.ObligationId + " is already " + ob.Status) }
+
+	ob.Status = OBLIGATION_CANCELLED
+	ob.CancelledBy = caller
+
+	err = t.save_obligation(stub, ob)
+	if err != nil { return nil, err }
+
+	pending, err := t.load_ids(stub, obligationIndexStr)
+	if err != nil { return nil, err }
+
+	remaining := []string{}
+	for _, id := range pending {
+		if id != ob.ObligationId { remaining = append(remaining, id) }
+	}
+
+	return nil, t.save_ids(stub, obligationIndexStr, remaining)
+}
+
+//==============================================================================================================================
+//	 get_obligations - Returns every obligation the caller owes or is owed, pending, settled or cancelled
+//==============================================================================================================================
+func (t *SimpleChaincode) get_obligations(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	err := identity.CheckArgs(args, 0)
+	if err != nil { return nil, err }
+
+	ids, err := t.load_ids(stub, participant_obligations_key(caller))
+	if err != nil { return nil, err }
+
+	obligations := []Obligation{}
+
+	for _, id := range ids {
+		ob, found, err := t.retrieve_obligation(stub, id)
+		if err != nil { return nil, err }
+		if found { obligations = append(obligations, ob) }
+	}
+
+	return json.Marshal(obligations)
+}
+
+//==============================================================================================================================
+//	 get_netting_cycle - Returns a stored netting cycle report, or the IDs of every cycle when none is given. Admins
+//						 see every report, other participants only those they had a position in.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_netting_cycle(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//Args
+	//				0
+	//			[cycleId]
+
+	admin, err := t.has_role(stub, caller, ADMIN)
+	if err != nil { return nil, err }
+
+	if len(args) == 0 {
+		if !admin { return nil, errors.New("Permission Denied. get_netting_cycle. Only admins can list every cycle") }
+
+		ids, err := t.load_ids(stub, cycleIndexStr)
+		if err != nil { return nil, err }
+		if ids == nil { ids = []string{} }
+
+		return json.Marshal(ids)
+	}
+
+	err = identity.CheckArgs(args, 1)
+	if err != nil { return nil, err }
+
+	bytes, err := stub.GetState(cycle_key(args[0]))
+	if err != nil { return nil, errors.New("Unable to get netting cycle " + args[0]) }
+	if bytes == nil { return nil, errors.New("No such netting cycle: " + args[0]) }
+
+	if admin { return bytes, nil }
+
+	var cycle Netting_Cycle
+
+	err = json.Unmarshal(bytes, &cycle)
+	if err != nil { return nil, errors.New("Corrupt netting cycle report") }
+
+	for _, pos := range cycle.Positions {
+		if pos.Participant == caller { return bytes, nil }
+	}
+
+	return nil, errors.New("Permission Denied. get_netting_cycle")
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sreedhar310/learn-chaincode/identity"
+	"github.com/sreedhar310/learn-chaincode/validate"
+)
+
+//==============================================================================================================================
+//	 Participant states
+//==============================================================================================================================
+
+const   ACTIVE     =  "active"
+const   SUSPENDED  =  "suspended"
+
+//==============================================================================================================================
+//	 KYC states
+//==============================================================================================================================
+
+const   KYC_PENDING   =  "pending"
+const   KYC_VERIFIED  =  "verified"
+const   KYC_REJECTED  =  "rejected"
+
+//==============================================================================================================================
+//	Participant - A registered user, the organisation it belongs to and the set of roles it acts in, so one company can
+//				  be both a SUPPLIER and a PAYER. Stored under participant:<name> so it can't collide with an invoice or any
+//				  other key. A suspended participant keeps its record but holds no roles as far as has_role is concerned.
+//==============================================================================================================================
+type Participant struct {
+	Name             string   `json:"name"`
+	DisplayName      string   `json:"displayname"`
+	Organisation     string   `json:"organisation"`
+	Roles            []string `json:"roles"`
+	KYCStatus        string   `json:"kycstatus"`
+	Contact          string   `json:"contact"`
+	BankRef          string   `json:"bankref"`
+	Status           string   `json:"status"`
+	Created          int64    `json:"created"`
+	Updated          int64    `json:"updated"`
+}
+
+//==============================================================================================================================
+//	Participant Details - The descriptive fields an admin may set at registration or change later
+//==============================================================================================================================
+type Participant_Details struct {
+	DisplayName      string   `json:"displayname"`
+	Organisation     string   `json:"organisation"`
+	Contact          string   `json:"contact"`
+	BankRef          string   `json:"bankref"`
+}
+
+//==============================================================================================================================
+//	Participant Holder - The names of every participant ever registered. Used as an index by list_participants.
+//==============================================================================================================================
+type Participant_Holder struct {
+	Participants 	[]string `json:"participants"`
+}
+
+//==============================================================================================================================
+//	Audit Entry - One change to the participant registry: who made it, when, and the participant's state afterwards
+//==============================================================================================================================
+type Audit_Entry struct {
+	TxId             string `json:"txid"`
+	Timestamp        int64  `json:"timestamp"`
+	Actor            string `json:"actor"`
+	Action           string `json:"action"`
+	Participant      string   `json:"participant"`
+	Roles            []string `json:"roles"`
+	KYCStatus        string   `json:"kycstatus"`
+	Status           string   `json:"status"`
+}
+
+type Audit_Holder struct {
+	Entries 	[]Audit_Entry `json:"entries"`
+}
+
+//	Keys contain ':', which invoice IDs can't, and read refuses them, so the registry is only seen through its own queries
+const   participantIndexStr  =  "participants:index"			// Names of every registered participant
+const   participantAuditStr  =  "participants:audit"			// Every change made to the registry, in order
+
+func participant_key(name string) string { return "participant:" + name }
+
+func valid_role(role string) bool {
+	return role == SUPPLIER || role == PAYER || role == BUYER || role == ADMIN
+}
+
+//==============================================================================================================================
+//	 parse_roles - Splits a comma separated role list such as "supplier,payer", refusing unknown or repeated roles
+//==============================================================================================================================
+func parse_roles(list string) ([]string, error) {
+
+	roles := []string{}
+
+	for _, role := range strings.Split(list, ",") {
+		role = strings.TrimSpace(role)
+		if !valid_role(role) { return nil, errors.New("Unknown role: " + role) }
+		if contains(roles, role) { return nil, errors.New("Role listed twice: " + role) }
+		roles = append(roles, role)
+	}
+
+	return roles, nil
+}
+
+func valid_kyc_status(status string) bool {
+	return status == KYC_PENDING || status == KYC_VERIFIED || status == KYC_REJECTED
+}
+
+//==============================================================================================================================
+//	 has_role - Reports whether the participant is registered, active and holds the role
+//==============================================================================================================================
+func (t *SimpleChaincode) has_role(stub shim.ChaincodeStubInterface, name string, role string) (bool, error) {
+
+	p, found, err := t.retrieve_participant(stub, name)
+	if err != nil { return false, errors.New("Couldn't retrieve roles for user " + name) }
+
+	return found && p.Status == ACTIVE && contains(p.Roles, role), nil
+}
+
+//==============================================================================================================================
+//	 check_role - Fails with a permission error naming the function unless the participant has the role
+//==============================================================================================================================
+func (t *SimpleChaincode) check_role(stub shim.ChaincodeStubInterface, name string, role string, function string) error {
+
+	ok, err := t.has_role(stub, name, role)
+	if err != nil { return err }
+
+	if !ok {
+		return errors.New(fmt.Sprintf("Permission Denied. %v. %v is not an active %v", function, name, role))
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 retrieve_participant - Returns the participant, with found false if no one by that name is registered
+//==============================================================================================================================
+func (t *SimpleChaincode) retrieve_participant(stub shim.ChaincodeStubInterface, name string) (Participant, bool, error) {
+
+	var p Participant
+
+	bytes, err := stub.GetState(participant_key(name))
+	if err != nil { return p, false, errors.New("RETRIEVE_PARTICIPANT: Error retrieving participant " + name) }
+	if bytes == nil { return p, false, nil }
+
+	err = json.Unmarshal(bytes, &p)
+	if err != nil { return p, false, errors.New("RETRIEVE_PARTICIPANT: Corrupt participant record " + string(bytes)) }
+
+	return p, true, nil
+}
+
+//==============================================================================================================================
+//	 save_participant - Stores the participant, adds it to the index if new, and appends the change to the audit trail
+//==============================================================================================================================
+func (t *SimpleChaincode) save_participant(stub shim.ChaincodeStubInterface, p Participant, actor string, action string) error {
+
+	now, err := t.get_tx_time(stub)
+	if err != nil { return err }
+
+	if action == "register" { p.Created = now }
+	p.Updated = now
+
+	bytes, err := json.Marshal(p)
+	if err != nil { return errors.New("Error converting participant record") }
+
+	err = stub.PutState(participant_key(p.Name), bytes)
+	if err != nil { return errors.New("Error storing participant record") }
+
+	if action == "register" {
+		var holder Participant_Holder
+
+		bytes, err = stub.GetState(participantIndexStr)
+		if err != nil { return errors.New("Unable to get the participant index") }
+
+		if bytes != nil {
+			err = json.Unmarshal(bytes, &holder)
+			if err != nil { return errors.New("Corrupt Participant_Holder record") }
+		}
+
+		holder.Participants = append(holder.Participants, p.Name)
+
+		bytes, err = json.Marshal(holder)
+		if err != nil { return errors.New("Error creating Participant_Holder record") }
+
+		err = stub.PutState(participantIndexStr, bytes)
+		if err != nil { return errors.New("Unable to put the participant index") }
+	}
+
+	var audit Audit_Holder
+
+	bytes, err = stub.GetState(participantAuditStr)
+	if err != nil { return errors.New("Unable to get the participant audit trail") }
+
+	if bytes != nil {
+		err = json.Unmarshal(bytes, &audit)
+		if err != nil { return errors.New("Corrupt Audit_Holder record") }
+	}
+
+	audit.Entries = append(audit.Entries, Audit_Entry{TxId: stub.GetTxID(), Timestamp: now, Actor: actor, Action: action, Participant: p.Name, Roles: p.Roles, KYCStatus: p.KYCStatus, Status: p.Status})
+
+	bytes, err = json.Marshal(audit)
+	if err != nil { return errors.New("Error creating Audit_Holder record") }
+
+	err = stub.PutState(participantAuditStr, bytes)
+	if err != nil { return errors.New("Unable to put the participant audit trail") }
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 check_admin - Fails unless the caller is an active ADMIN
+//==============================================================================================================================
+func (t *SimpleChaincode) check_admin(stub shim.ChaincodeStubInterface, caller string, function string) error {
+
+	return t.check_role(stub, caller, ADMIN, function)
+}
+
+//=================================================================================================================================
+//	 register_participant - Registers a participant with one or more roles. KYC starts out pending.
+//=================================================================================================================================
+func (t *SimpleChaincode) register_participant(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//Args
+	//				0                 1
+	//			test_user3      supplier,payer
+	//	or with the participant's details
+	//				0                 1                                               2
+	//			test_user3      supplier,payer     {"displayname":"Acme Ltd","organisation":"acme","bankref":"GB-ACME-001"}
+
+	if len(args) != 2 && len(args) != 3 { return nil, errors.New("Incorrect number of arguments. Expecting 2 or 3") }
+
+	err := validate.Name(args[0])
+	if err != nil { return nil, err }
+
+	roles, err := parse_roles(args[1])
+	if err != nil { return nil, err }
+
+	_, found, err := t.retrieve_participant(stub, args[0])
+	if err != nil { return nil, err }
+	if found { return nil, errors.New("Participant already exists: " + args[0]) }
+
+	p := Participant{Name: args[0], DisplayName: args[0], Roles: roles, KYCStatus: KYC_PENDING, Status: ACTIVE}
+
+	if len(args) == 3 {
+		p, err = apply_details(p, args[2])
+		if err != nil { return nil, err }
+	}
+
+	err = t.save_participant(stub, p, caller, "register")
+	if err != nil { fmt.Printf("REGISTER_PARTICIPANT: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+
+	return nil, nil
+}
+
+//==============================================================================================================================
+//	 apply_details - Copies the fields present in a Participant_Details JSON onto the participant
+//==============================================================================================================================
+func apply_details(p Participant, details string) (Participant, error) {
+
+	var d Participant_Details
+
+	err := json.Unmarshal([]byte(details), &d)
+	if err != nil { return p, errors.New("Invalid participant details JSON") }
+
+	if d.DisplayName != "" { p.DisplayName = d.DisplayName }
+	if d.Organisation != "" { p.Organisation = d.Organisation }
+	if d.Contact != "" { p.Contact = d.Contact }
+	if d.BankRef != "" { p.BankRef = d.BankRef }
+
+	return p, nil
+}
+
+//=================================================================================================================================
+//	 update_participant_roles - Replaces the set of roles a participant acts in
+//=================================================================================================================================
+func (t *SimpleChaincode) update_participant_roles(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//Args
+	//				0                 1
+	//			test_user3      supplier,payer
+
+	err := identity.CheckArgs(args, 2)
+	if err != nil { return nil, err }
+
+	roles, err := parse_roles(args[1])
+	if err != nil { return nil, err }
+
+	p, found, err := t.retrieve_participant(stub, args[0])
+	if err != nil { return nil, err }
+	if !found { return nil, errors.New("No participant " + args[0]) }
+
+	if p.Name == caller && !contains(roles, ADMIN) {						// The caller stays an admin, so the registry always keeps one
+		return nil, errors.New("Permission Denied. update_participant_roles. Admins can't remove their own admin role")
+	}
+
+	p.Roles = roles
+
+	err = t.save_participant(stub, p, caller, "update_roles")
+	if err != nil { fmt.Printf("UPDATE_PARTICIPANT_ROLES: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 update_participant_details - Changes a participant's display name, organisation, contact or bank details reference
+//=================================================================================================================================
+func (t *SimpleChaincode) update_participant_details(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//Args
+	//				0                            1
+	//			test_user3      {"contact":"treasury@acme.example"}
+
+	err := identity.CheckArgs(args, 2)
+	if err != nil { return nil, err }
+
+	p, found, err := t.retrieve_participant(stub, args[0])
+	if err != nil { return nil, err }
+	if !found { return nil, errors.New("No participant " + args[0]) }
+
+	p, err = apply_details(p, args[1])
+	if err != nil { return nil, err }
+
+	err = t.save_participant(stub, p, caller, "update_details")
+	if err != nil { fmt.Printf("UPDATE_PARTICIPANT_DETAILS: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 update_participant_kyc - Records the outcome of a participant's KYC checks
+//=================================================================================================================================
+func (t *SimpleChaincode) update_participant_kyc(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//Args
+	//				0               1
+	//			test_user3       verified
+
+	err := identity.CheckArgs(args, 2)
+	if err != nil { return nil, err }
+
+	if !valid_kyc_status(args[1]) { return nil, errors.New("Unknown KYC status: " + args[1]) }
+
+	p, found, err := t.retrieve_participant(stub, args[0])
+	if err != nil { return nil, err }
+	if !found { return nil, errors.New("No participant " + args[0]) }
+
+	p.KYCStatus = args[1]
+
+	err = t.save_participant(stub, p, caller, "update_kyc")
+	if err != nil { fmt.Printf("UPDATE_PARTICIPANT_KYC: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 set_participant_status - Backs suspend_participant and reinstate_participant
+//=================================================================================================================================
+func (t *SimpleChaincode) set_participant_status(stub shim.ChaincodeStubInterface, caller string, args []string, status string, function string) ([]byte, error) {
+
+	//Args
+	//				0
+	//			test_user3
+
+	err := identity.CheckArgs(args, 1)
+	if err != nil { return nil, err }
+
+	if args[0] == caller { return nil, errors.New(fmt.Sprintf("Permission Denied. %v. Admins can't change their own status", function)) }
+
+	p, found, err := t.retrieve_participant(stub, args[0])
+	if err != nil { return nil, err }
+	if !found { return nil, errors.New("No participant " + args[0]) }
+
+	if p.Status == status { return nil, errors.New(fmt.Sprintf("Participant %v is already %v", p.Name, status)) }
+
+	p.Status = status
+
+	err = t.save_participant(stub, p, caller, function)
+	if err != nil { fmt.Printf("SET_PARTICIPANT_STATUS: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 list_participants - Returns every registered participant, active or not
+//=================================================================================================================================
+func (t *SimpleChaincode) list_participants(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//Args
+	//	none
+
+	err := identity.CheckArgs(args, 0)
+	if err != nil { return nil, err }
+
+	var holder Participant_Holder
+
+	bytes, err := stub.GetState(participantIndexStr)
+	if err != nil { return nil, errors.New("Unable to get the participant index") }
+
+	if bytes != nil {
+		err = json.Unmarshal(bytes, &holder)
+		if err != nil { return nil, errors.New("Corrupt Participant_Holder record") }
+	}
+
+	participants := []Participant{}
+
+	for _, name := range holder.Participants {
+		p, found, err := t.retrieve_participant(stub, name)
+		if err != nil { return nil, err }
+		if found { participants = append(participants, p) }
+	}
+
+	return json.Marshal(participants)
+}
+
+//=================================================================================================================================
+//	 get_participant - Returns a participant's record to the participant itself or to an admin
+//=================================================================================================================================
+func (t *SimpleChaincode) get_participant(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//Args
+	//				0
+	//			test_user3
+
+	err := identity.CheckArgs(args, 1)
+	if err != nil { return nil, err }
+
+	if args[0] != caller {
+		err := t.check_admin(stub, caller, "get_participant")
+		if err != nil { return nil, err }
+	}
+
+	p, found, err := t.retrieve_participant(stub, args[0])
+	if err != nil { return nil, err }
+	if !found { return nil, errors.New("No participant " + args[0]) }
+
+	return json.Marshal(p)
+}
+
+//=================================================================================================================================
+//	 get_participant_audit - Returns the audit trail of registry changes
+//=================================================================================================================================
+func (t *SimpleChaincode) get_participant_audit(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//Args
+	//	none
+
+	err := identity.CheckArgs(args, 0)
+	if err != nil { return nil, err }
+
+	bytes, err := stub.GetState(participantAuditStr)
+	if err != nil { return nil, errors.New("Unable to get the participant audit trail") }
+
+	if bytes == nil { return json.Marshal(Audit_Holder{Entries: []Audit_Entry{}}) }
+
+	return bytes, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	 Access Policies
+//==============================================================================================================================
+//	Every function the routers dispatch has an entry in the policy table below and is checked against it before it runs.
+//	A function with no entry can't be called. A policy is met when all of the following hold:
+//
+//		Roles		- the caller is an active participant with one of these roles, or anyone if the list is empty
+//		Attributes	- each transaction certificate attribute named has exactly the value given
+//		Owner		- at least one of these predicates holds for the caller and the invoice named by the first argument
+//
+//	Some rules depend on more than the caller's roles and the invoice's parties, e.g. who the payer's signatories are or
+//	who a program's funders are. Those functions have an open entry here and check the rest themselves.
+//==============================================================================================================================
+
+const   CALLER_IS_SUPPLIER   =  "caller == inv.Supplier"
+const   CALLER_IS_PAYER      =  "caller == inv.Payer"
+const   CALLER_IS_BUYER      =  "caller == inv.Buyer"
+
+var owner_predicates = map[string]func(caller string, inv Invoice) bool{
+	CALLER_IS_SUPPLIER:	func(caller string, inv Invoice) bool { return caller == inv.Supplier },
+	CALLER_IS_PAYER:	func(caller string, inv Invoice) bool { return caller == inv.Payer },
+	CALLER_IS_BUYER:	func(caller string, inv Invoice) bool { return caller == inv.Buyer },
+}
+
+//==============================================================================================================================
+//	Policy - The requirements a caller has to meet to call a function
+//==============================================================================================================================
+type Policy struct {
+	Roles            []string          `json:"roles,omitempty"`
+	Attributes       map[string]string `json:"attributes,omitempty"`
+	Owner            []string          `json:"owner,omitempty"`
+}
+
+var policies = map[string]Policy{
+	"create_invoice":				{Roles: []string{SUPPLIER}},
+	"approve_trade":				{},
+	"reject_trade":					{},
+	"accept_trade":					{Roles: []string{BUYER}},
+	"expire_trade":					{},
+	"init_account":					{},
+	"fund_account":					{Roles: []string{ADMIN}},
+	"register_participant":			{Roles: []string{ADMIN}},
+	"update_participant_roles":		{Roles: []string{ADMIN}},
+	"update_participant_details":	{Roles: []string{ADMIN}},
+	"update_participant_kyc":		{Roles: []string{ADMIN}},
+	"suspend_participant":			{Roles: []string{ADMIN}},
+	"reinstate_participant":		{Roles: []string{ADMIN}},
+	"set_approval_policy":			{Roles: []string{PAYER}},
+	"create_program":				{Roles: []string{PAYER}},
+	"add_program_supplier":			{Roles: []string{PAYER}},
+	"add_program_funder":			{Roles: []string{PAYER}},
+	"approve_invoice_for_program":	{},
+	"request_early_payment":		{Roles: []string{SUPPLIER}, Owner: []string{CALLER_IS_SUPPLIER}},
+	"fund_early_payment":			{Roles: []string{BUYER}},
+	"set_fee_rule":					{Roles: []string{ADMIN}},
+	"remove_fee_rule":				{Roles: []string{ADMIN}},
+	"set_fee_account":				{Roles: []string{ADMIN}},
+	"register_obligation":			{},
+	"register_invoice_obligation":	{Owner: []string{CALLER_IS_PAYER, CALLER_IS_BUYER}},
+	"cancel_obligation":			{},
+	"run_netting_cycle":			{Roles: []string{ADMIN}},
+
+	"get_invoice_details":			{Owner: []string{CALLER_IS_SUPPLIER, CALLER_IS_PAYER, CALLER_IS_BUYER}},
+	"get_invoices":					{},
+	"get_opening_trade_invoices":	{},
+	"get_escrow":					{},
+	"get_buyer_escrows":			{},
+	"list_participants":			{Roles: []string{ADMIN}},
+	"get_participant":				{},
+	"get_participant_audit":		{Roles: []string{ADMIN}},
+	"get_approval_policy":			{},
+	"get_approvals":				{},
+	"get_program":					{},
+	"get_trial_balance":			{},
+	"get_fee_schedule":				{},
+	"get_fee_report":				{},
+	"get_obligations":				{},
+	"get_netting_cycle":			{},
+	"get_invoice_schema":			{},
+	"get_permissions":				{},
+	"get_username":					{},
+	"read":							{},
+}
+
+//==============================================================================================================================
+//	Permission - What get_permissions reports for one function. Conditions lists the ownership predicates that still
+//				 have to hold for a particular invoice when no invoice was given.
+//==============================================================================================================================
+type Permission struct {
+	Function         string   `json:"function"`
+	Allowed          bool     `json:"allowed"`
+	Policy           Policy   `json:"policy"`
+	Conditions       []string `json:"conditions,omitempty"`
+	Reason           string   `json:"reason,omitempty"`
+}
+
+//==============================================================================================================================
+//	 check_policy - Checks the role and certificate attribute requirements of a function's policy
+//==============================================================================================================================
+func (t *SimpleChaincode) check_policy(stub shim.ChaincodeStubInterface, function string, p Policy, caller string) error {
+
+	if len(p.Roles) > 0 {
+		allowed := false
+		for _, role := range p.Roles {
+			ok, err := t.has_role(stub, caller, role)
+			if err != nil { return err }
+			if ok { allowed = true; break }
+		}
+		if !allowed {
+			return errors.New(fmt.Sprintf("Permission Denied. %v. %v is not an active %v", function, caller, p.Roles))
+		}
+	}
+
+	for name, value := range p.Attributes {
+		attr, err := stub.ReadCertAttribute(name)
+		if err != nil { return errors.New(fmt.Sprintf("Permission Denied. %v. Couldn't get attribute '%v'", function, name)) }
+		if string(attr) != value { return errors.New(fmt.Sprintf("Permission Denied. %v. %v %v !== %v", function, name, string(attr), value)) }
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 check_owner - Checks that at least one of a policy's ownership predicates holds for the invoice
+//==============================================================================================================================
+func (t *SimpleChaincode) check_owner(function string, p Policy, caller string, inv Invoice) error {
+
+	if len(p.Owner) == 0 { return nil }
+
+	for _, name := range p.Owner {
+		if owner_predicates[name](caller, inv) { return nil }
+	}
+
+	return errors.New(fmt.Sprintf("Permission Denied. %v. None of %v holds for invoice %v", function, p.Owner, inv.InvoiceId))
+}
+
+//==============================================================================================================================
+//	 authorize - Called by the routers before dispatch. Fails unless the caller meets the function's policy.
+//==============================================================================================================================
+func (t *SimpleChaincode) authorize(stub shim.ChaincodeStubInterface, function string, caller string, args []string) error {
+
+	p, ok := policies[function]
+	if !ok { return errors.New("Permission Denied. No policy for function " + function) }
+
+	err := t.check_policy(stub, function, p, caller)
+	if err != nil { return err }
+
+	if len(p.Owner) == 0 { return nil }
+
+	if len(args) == 0 { return errors.New("Incorrect number of arguments. Expecting an invoice ID") }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return err }
+
+	return t.check_owner(function, p, caller, inv)
+}
+
+//==============================================================================================================================
+//	 get_permissions - Reports which functions the caller may call. With an invoice ID the ownership predicates are
+//					   checked against that invoice, otherwise they are returned as conditions.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_permissions(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//Args
+	//				0
+	//			123443232	(optional)
+
+	if len(args) > 1 { return nil, errors.New("Incorrect number of arguments. Expecting 0 or 1") }
+
+	var inv *Invoice
+
+	if len(args) == 1 {
+		found, err := t.retrieve_invoice(stub, args[0])
+		if err != nil { return nil, err }
+		inv = &found
+	}
+
+	var functions []string
+	for function := range policies { functions = append(functions, function) }
+	sort.Strings(functions)
+
+	var result []Permission
+
+	for _, function := range functions {
+
+		p := policies[function]
+		perm := Permission{Function: function, Policy: p}
+
+		err := t.check_policy(stub, function, p, caller)
+		if err == nil && inv != nil {
+			err = t.check_owner(function, p, caller, *inv)
+		} else if err == nil {
+			perm.Conditions = p.Owner
+		}
+
+		if err != nil {
+			perm.Reason = err.Error()
+		} else {
+			perm.Allowed = true
+		}
+
+		result = append(result, perm)
+	}
+
+	return json.Marshal(result)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sreedhar310/learn-chaincode/identity"
+	"github.com/sreedhar310/learn-chaincode/validate"
+)
+
+//==============================================================================================================================
+//	Program - Defines a reverse factoring (payer-led supply chain finance) program. The payer approves its suppliers'
+//			  invoices up front and the suppliers can then be paid early by one of the program's funders at the
+//			  program's discount rate, which reflects the payer's credit rather than the supplier's.
+//==============================================================================================================================
+type Program struct {
+	ProgramId        string   `json:"programid"`
+	Payer            string   `json:"payer"`
+	Rate             string   `json:"rate"`
+	Suppliers        []string `json:"suppliers"`
+	Funders          []string `json:"funders"`
+}
+
+//==============================================================================================================================
+//	Early Payment Request - A supplier's request that one of the program's funders pays an invoice early. Nothing is
+//							debited until the funder accepts it with fund_early_payment.
+//==============================================================================================================================
+type Early_Payment_Request struct {
+	InvoiceId        string `json:"invoiceid"`
+	Supplier         string `json:"supplier"`
+	Funder           string `json:"funder"`
+	Requested        int64  `json:"requested"`
+}
+
+func program_key(programId string) string { return "program:" + programId }
+func early_payment_key(invoiceId string) string { return "earlypayment:" + invoiceId }
+
+func contains(list []string, name string) bool {
+	for _, val := range list {
+		if val == name { return true }
+	}
+	return false
+}
+
+//==============================================================================================================================
+//	 retrieve_program
+//==============================================================================================================================
+func (t *SimpleChaincode) retrieve_program(stub shim.ChaincodeStubInterface, programId string) (Program, error) {
+
+	var prog Program
+
+	bytes, err := stub.GetState(program_key(programId))
+	if err != nil { return prog, errors.New("RETRIEVE_PROGRAM: Error retrieving program " + programId) }
+	if bytes == nil { return prog, errors.New("RETRIEVE_PROGRAM: No program " + programId) }
+
+	err = json.Unmarshal(bytes, &prog)
+	if err != nil { return prog, errors.New("RETRIEVE_PROGRAM: Corrupt program record " + string(bytes)) }
+
+	return prog, nil
+}
+
+func (t *SimpleChaincode) save_program(stub shim.ChaincodeStubInterface, prog Program) error {
+
+	bytes, err := json.Marshal(prog)
+	if err != nil { return errors.New("Error converting program record") }
+
+	err = stub.PutState(program_key(prog.ProgramId), bytes)
+	if err != nil { return errors.New("Error storing program record") }
+
+	return nil
+}
+
+//=================================================================================================================================
+//	 create_program - A payer opens a program with the discount rate its funders will charge
+//=================================================================================================================================
+func (t *SimpleChaincode) create_program(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//Args
+	//				0               1
+	//			 prog001          0.02
+
+	err := identity.CheckArgs(args, 2)
+	if err != nil { return nil, err }
+
+	var programId = args[0]
+
+	err = validate.ID(programId)
+	if err != nil { return nil, errors.New("Invalid program ID: " + err.Error()) }
+
+	rate, err := validate.Rate(args[1])
+	if err != nil { return nil, errors.New("Invalid program rate: " + err.Error()) }
+
+	record, err := stub.GetState(program_key(programId))
+	if record != nil { return nil, errors.New("Program already exists") }
+
+	prog := Program{ProgramId: programId, Payer: caller, Rate: strconv.FormatFloat(rate, 'f', -1, 64), Suppliers: []string{}, Funders: []string{}}
+
+	err = t.save_program(stub, prog)
+	if err != nil { fmt.Printf("CREATE_PROGRAM: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 add_program_member - The program's payer registers an approved supplier or funder. Funders are participants
+//						  with the BUYER role.
+//=================================================================================================================================
+func (t *SimpleChaincode) add_program_member(stub shim.ChaincodeStubInterface, caller string, args []string, member_role string) ([]byte, error) {
+
+	//Args
+	//				0               1
+	//			 prog001       test_user0
+
+	err := identity.CheckArgs(args, 2)
+	if err != nil { return nil, err }
+
+	var member = args[1]
+
+	prog, err := t.retrieve_program(stub, args[0])
+	if err != nil { return nil, err }
+
+	if caller != prog.Payer {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. add_program_member. %v !== %v", caller, prog.Payer))
+	}
+
+	err = t.check_role(stub, member, member_role, "add_program_member")
+	if err != nil { return nil, err }
+
+	if member_role == SUPPLIER {
+		if !contains(prog.Suppliers, member) { prog.Suppliers = append(prog.Suppliers, member) }
+	} else {
+		if !contains(prog.Funders, member) { prog.Funders = append(prog.Funders, member) }
+	}
+
+	err = t.save_program(stub, prog)
+	if err != nil { fmt.Printf("ADD_PROGRAM_MEMBER: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 approve_invoice_for_program - The payer confirms an open invoice from one of the program's suppliers, which makes
+//								   it eligible for early payment once the payer's approval policy is satisfied
+//=================================================================================================================================
+func (t *SimpleChaincode) approve_invoice_for_program(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//Args
+	//				0               1
+	//			123443232        prog001
+
+	err := identity.CheckArgs(args, 2)
+	if err != nil { return nil, err }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return nil, err }
+
+	prog, err := t.retrieve_program(stub, args[1])
+	if err != nil { return nil, err }
+
+	if inv.Payer != prog.Payer {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. approve_invoice_for_program. %v !== %v", inv.Payer, prog.Payer))
+	}
+
+	if !contains(prog.Suppliers, inv.Supplier) {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. approve_invoice_for_program. %v is not a supplier in program %v", inv.Supplier, prog.ProgramId))
+	}
+
+	if inv.Status != "0" || inv.Program != "" {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. approve_invoice_for_program. This invoice isn't open for trade"))
+	}
+
+	complete, err := t.record_approval(stub, inv, caller, "approve_invoice_for_program", APPROVE_PROGRAM, prog.ProgramId)						// The payer's approval policy applies here as well
+	if err != nil { return nil, err }
+
+	if !complete { return nil, nil }
+
+	inv.Program = prog.ProgramId
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("APPROVE_INVOICE_FOR_PROGRAM: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 request_early_payment - The supplier asks one of the program's funders to pay a program-approved invoice early. A
+//							 later request replaces an earlier one that hasn't been funded.
+//=================================================================================================================================
+func (t *SimpleChaincode) request_early_payment(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//Args
+	//				0               1
+	//			123443232       test_user2
+
+	err := identity.CheckArgs(args, 2)
+	if err != nil { return nil, err }
+
+	var funder = args[1]
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return nil, err }
+
+	if inv.Program == "" || inv.Status != "0" {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. request_early_payment. This invoice hasn't been approved for a program"))
+	}
+
+	prog, err := t.retrieve_program(stub, inv.Program)
+	if err != nil { return nil, err }
+
+	if !contains(prog.Funders, funder) {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. request_early_payment. %v is not a funder in program %v", funder, prog.ProgramId))
+	}
+
+	now, err := t.get_tx_time(stub)
+	if err != nil { return nil, err }
+
+	bytes, err := json.Marshal(Early_Payment_Request{InvoiceId: inv.InvoiceId, Supplier: caller, Funder: funder, Requested: now})
+	if err != nil { return nil, errors.New("Error converting early payment request") }
+
+	err = stub.PutState(early_payment_key(inv.InvoiceId), bytes)
+	if err != nil { return nil, errors.New("Error storing early payment request") }
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 fund_early_payment - The funder named in a supplier's request pays the invoice at the program's discount rate. The
+//						  invoice goes through the usual accepted and approved states in a single transaction, since the
+//						  payer has already confirmed it.
+//=================================================================================================================================
+func (t *SimpleChaincode) fund_early_payment(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//Args
+	//				0
+	//			123443232
+
+	err := identity.CheckArgs(args, 1)
+	if err != nil { return nil, err }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return nil, err }
+
+	var req Early_Payment_Request
+
+	bytes, err := stub.GetState(early_payment_key(inv.InvoiceId))
+	if err != nil { return nil, errors.New("Unable to get early payment request for invoice " + inv.InvoiceId) }
+	if bytes == nil { return nil, errors.New("No early payment has been requested for invoice " + inv.InvoiceId) }
+
+	err = json.Unmarshal(bytes, &req)
+	if err != nil { return nil, errors.New("Corrupt early payment request " + string(bytes)) }
+
+	if caller != req.Funder {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. fund_early_payment. %v !== %v", caller, req.Funder))
+	}
+
+	if inv.Program == "" || inv.Status != "0" || req.Supplier != inv.Supplier {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. fund_early_payment. This invoice is no longer waiting for early payment"))
+	}
+
+	prog, err := t.retrieve_program(stub, inv.Program)
+	if err != nil { return nil, err }
+
+	if !contains(prog.Funders, caller) {
+		return nil, errors.New(fmt.Sprintf("Permission Denied. fund_early_payment. %v is not a funder in program %v", caller, prog.ProgramId))
+	}
+
+	price, err := purchase_price(inv, prog.Rate)										// Funders charge the program rate, the invoice keeps its own discount
+	if err != nil { return nil, err }
+
+	err = t.lock_escrow(stub, inv, caller, price)
+	if err != nil { fmt.Printf("FUND_EARLY_PAYMENT: Error locking escrow: %s", err); return nil, errors.New("Error locking escrow: " + err.Error()) }
+
+	inv.Buyer = caller
+	inv.Status = "1"
+
+	err = t.settle_escrow(stub, inv.InvoiceId, caller, ESCROW_RELEASED)
+	if err != nil { fmt.Printf("FUND_EARLY_PAYMENT: Error releasing escrow: %s", err); return nil, errors.New("Error releasing escrow: " + err.Error()) }
+
+	inv.Status = "2"
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("FUND_EARLY_PAYMENT: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+
+	err = stub.DelState(early_payment_key(inv.InvoiceId))
+	if err != nil { return nil, errors.New("Unable to remove early payment request for invoice " + inv.InvoiceId) }
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 get_program - Returns a program to its payer, or to one of its suppliers or funders
+//=================================================================================================================================
+func (t *SimpleChaincode) get_program(stub shim.ChaincodeStubInterface, caller string, args []string) ([]byte, error) {
+
+	//Args
+	//				0
+	//			 prog001
+
+	err := identity.CheckArgs(args, 1)
+	if err != nil { return nil, err }
+
+	prog, err := t.retrieve_program(stub, args[0])
+	if err != nil { return nil, err }
+
+	if caller != prog.Payer && !contains(prog.Suppliers, caller) && !contains(prog.Funders, caller) {
+		return nil, errors.New("Permission Denied. get_program")
+	}
+
+	return json.Marshal(prog)
+}
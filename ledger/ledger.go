@@ -0,0 +1,272 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// Package ledger is the double-entry general ledger shared by the account and
+// invoice2 chaincodes. Every movement of money is posted as an entry whose
+// debit and credit lines balance in each currency, so the trial balance of
+// the whole ledger always nets to zero.
+//
+// The other chaincodes don't post to it. invoice and invoice1 hold no
+// balances, a trade there only changes the invoice's status. account1 and
+// mino are the unrestricted samples the account chaincode grew from: anyone
+// can open an account with any balance or write and delete any key, so
+// balances can change without a transaction the ledger could record, and its
+// guarantees couldn't hold there.
+package ledger
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// The ledger accounts that aren't tied to a customer account
+const (
+	Fees            = "fees"
+	Escrow          = "escrow"
+	Suspense        = "suspense"
+	FXPosition      = "fx_position"
+	Interest        = "interest_income"
+	Issuance        = "issuance"
+	InterestExpense = "interest_expense"
+	InterestPayable = "interest_payable"
+)
+
+// Keys start with "gl:" and contain ':', which account numbers and invoice IDs can't, so they never clash with other records
+const (
+	accountPrefix = "gl:account:"
+	entryPrefix   = "gl:entry:"
+	indexKey      = "gl:accounts"
+)
+
+// tolerance is how far debits and credits may drift apart through float rounding and still balance
+const tolerance = 1e-6
+
+// Customer is the ledger account mirroring a customer's account
+func Customer(accountNo string) string {
+	return "customer:" + accountNo
+}
+
+// Line is one side of an entry. Exactly one of Debit and Credit is non-zero.
+type Line struct {
+	Account  string  `json:"account"`
+	Currency string  `json:"currency"`
+	Debit    float64 `json:"debit,omitempty"`
+	Credit   float64 `json:"credit,omitempty"`
+}
+
+// Debit returns a debit line
+func Debit(account string, currency string, amount float64) Line {
+	return Line{Account: account, Currency: currency, Debit: amount}
+}
+
+// Credit returns a credit line
+func Credit(account string, currency string, amount float64) Line {
+	return Line{Account: account, Currency: currency, Credit: amount}
+}
+
+// Entry is a balanced set of lines posted together
+type Entry struct {
+	TxId  string `json:"txid"`
+	Memo  string `json:"memo"`
+	Lines []Line `json:"lines"`
+}
+
+// Totals are the debits and credits posted to a ledger account in one currency
+type Totals struct {
+	Debits  float64 `json:"debits"`
+	Credits float64 `json:"credits"`
+}
+
+// Account is a ledger account with its totals by currency
+type Account struct {
+	Name   string            `json:"name"`
+	Totals map[string]Totals `json:"totals"`
+}
+
+// Row is one line of the trial balance
+type Row struct {
+	Account  string  `json:"account"`
+	Currency string  `json:"currency"`
+	Debits   float64 `json:"debits"`
+	Credits  float64 `json:"credits"`
+	Balance  float64 `json:"balance"`
+}
+
+// TrialBalance lists every ledger account and currency with the totals per currency. Balanced is true when debits
+// equal credits in every currency.
+type TrialBalance struct {
+	Rows     []Row             `json:"rows"`
+	Totals   map[string]Totals `json:"totals"`
+	Balanced bool              `json:"balanced"`
+}
+
+// Post checks the lines balance in each currency and records them as one entry
+func Post(stub shim.ChaincodeStubInterface, memo string, lines ...Line) error {
+	if len(lines) < 2 {
+		return errors.New("An entry needs at least two lines")
+	}
+
+	net := map[string]float64{}
+	for _, l := range lines {
+		if l.Account == "" || l.Currency == "" {
+			return errors.New("Every line needs a ledger account and a currency")
+		}
+		if l.Debit < 0 || l.Credit < 0 || (l.Debit == 0) == (l.Credit == 0) {
+			return fmt.Errorf("Line for %v must have exactly one positive side", l.Account)
+		}
+		net[l.Currency] += l.Debit - l.Credit
+	}
+	for currency, diff := range net {
+		if math.Abs(diff) > tolerance {
+			return fmt.Errorf("Unbalanced entry. Debits and credits in %v differ by %v", currency, diff)
+		}
+	}
+
+	for _, l := range lines {
+		acc, err := retrieve(stub, l.Account)
+		if err != nil {
+			return err
+		}
+		totals := acc.Totals[l.Currency]
+		totals.Debits += l.Debit
+		totals.Credits += l.Credit
+		acc.Totals[l.Currency] = totals
+		if err = save(stub, acc); err != nil {
+			return err
+		}
+	}
+
+	var entries []Entry
+	key := entryPrefix + stub.GetTxID()
+	if err := load(stub, key, &entries); err != nil {
+		return err
+	}
+	entries = append(entries, Entry{TxId: stub.GetTxID(), Memo: memo, Lines: lines})
+	return store(stub, key, entries)
+}
+
+// Entries returns the entries posted by a transaction
+func Entries(stub shim.ChaincodeStubInterface, txid string) ([]Entry, error) {
+	var entries []Entry
+	err := load(stub, entryPrefix+txid, &entries)
+	return entries, err
+}
+
+// Trial adds up every ledger account into a trial balance
+func Trial(stub shim.ChaincodeStubInterface) (TrialBalance, error) {
+	tb := TrialBalance{Rows: []Row{}, Totals: map[string]Totals{}, Balanced: true}
+
+	var index []string
+	if err := load(stub, indexKey, &index); err != nil {
+		return tb, err
+	}
+
+	for _, name := range index {
+		acc, err := retrieve(stub, name)
+		if err != nil {
+			return tb, err
+		}
+
+		var currencies []string
+		for currency := range acc.Totals {
+			currencies = append(currencies, currency)
+		}
+		sort.Strings(currencies)
+
+		for _, currency := range currencies {
+			t := acc.Totals[currency]
+			tb.Rows = append(tb.Rows, Row{Account: name, Currency: currency, Debits: t.Debits, Credits: t.Credits, Balance: t.Debits - t.Credits})
+
+			sum := tb.Totals[currency]
+			sum.Debits += t.Debits
+			sum.Credits += t.Credits
+			tb.Totals[currency] = sum
+		}
+	}
+
+	for _, sum := range tb.Totals {
+		if math.Abs(sum.Debits-sum.Credits) > tolerance {
+			tb.Balanced = false
+		}
+	}
+	return tb, nil
+}
+
+// GetTrialBalance is the get_trial_balance query, returning the trial balance as JSON
+func GetTrialBalance(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	tb, err := Trial(stub)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(tb)
+}
+
+// retrieve returns a ledger account, opening it if it has never been posted to
+func retrieve(stub shim.ChaincodeStubInterface, name string) (Account, error) {
+	acc := Account{Name: name, Totals: map[string]Totals{}}
+
+	bytes, err := stub.GetState(accountPrefix + name)
+	if err != nil {
+		return acc, errors.New("Failed to get ledger account " + name)
+	}
+	if bytes != nil {
+		if err = json.Unmarshal(bytes, &acc); err != nil {
+			return acc, errors.New("Corrupt ledger account " + name)
+		}
+		return acc, nil
+	}
+
+	var index []string
+	if err = load(stub, indexKey, &index); err != nil {
+		return acc, err
+	}
+	return acc, store(stub, indexKey, append(index, name))
+}
+
+func save(stub shim.ChaincodeStubInterface, acc Account) error {
+	return store(stub, accountPrefix+acc.Name, acc)
+}
+
+// load unmarshals the record at key into v, leaving v untouched if there is no record
+func load(stub shim.ChaincodeStubInterface, key string, v interface{}) error {
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		return errors.New("Failed to get " + key)
+	}
+	if bytes == nil {
+		return nil
+	}
+	if err = json.Unmarshal(bytes, v); err != nil {
+		return errors.New("Corrupt ledger record " + key)
+	}
+	return nil
+}
+
+func store(stub shim.ChaincodeStubInterface, key string, v interface{}) error {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return errors.New("Failed to convert ledger record " + key)
+	}
+	return stub.PutState(key, bytes)
+}
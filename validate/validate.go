@@ -0,0 +1,199 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// Package validate holds the field checks shared by the invoice and account
+// chaincodes, so that records are built from validated values rather than by
+// gluing arguments into JSON strings.
+package validate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// MaxIDLength is the longest invoice ID or account number accepted
+const MaxIDLength = 64
+
+// MaxNameLength is the longest participant name accepted
+const MaxNameLength = 64
+
+// Currencies lists the ISO 4217 codes the network accepts
+var Currencies = []string{"USD", "EUR", "GBP", "JPY", "CHF", "CAD", "AUD", "CNY", "INR", "SGD"}
+
+// InvoiceSchema is the published JSON schema for the optional create_invoice payload
+const InvoiceSchema = `{
+  "$schema": "http://json-schema.org/draft-04/schema#",
+  "title": "invoice",
+  "type": "object",
+  "properties": {
+    "invoiceid": {"type": "string", "pattern": "^[A-Za-z0-9._-]{1,64}$"},
+    "amount":    {"type": "string", "pattern": "^[0-9]+(\\.[0-9]{1,2})?$"},
+    "currency":  {"type": "string", "enum": ["USD", "EUR", "GBP", "JPY", "CHF", "CAD", "AUD", "CNY", "INR", "SGD"]},
+    "supplier":  {"type": "string"},
+    "payer":     {"type": "string"},
+    "duedate":   {"type": "string"},
+    "discount":  {"type": "string", "pattern": "^0(\\.[0-9]+)?$"}
+  },
+  "required": ["invoiceid", "amount", "payer"],
+  "additionalProperties": false
+}`
+
+// ID checks an invoice ID or account number: 1 to MaxIDLength letters, digits, '.', '_' or '-'
+func ID(id string) error {
+	if len(id) == 0 || len(id) > MaxIDLength {
+		return fmt.Errorf("ID must be between 1 and %d characters", MaxIDLength)
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return errors.New("ID may only contain letters, digits, '.', '_' and '-': " + id)
+		}
+	}
+	return nil
+}
+
+// Name checks a participant name is present, not too long and free of control characters
+func Name(name string) error {
+	if len(name) == 0 || len(name) > MaxNameLength {
+		return fmt.Errorf("Name must be between 1 and %d characters", MaxNameLength)
+	}
+	for _, c := range name {
+		if c < ' ' || c == '"' || c == '\\' || c == 0x7f {
+			return errors.New("Name contains an invalid character: " + strconv.Quote(name))
+		}
+	}
+	return nil
+}
+
+// number parses a finite decimal amount
+func number(value string) (float64, error) {
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0, errors.New("Expecting a numeric string, got " + strconv.Quote(value))
+	}
+	return n, nil
+}
+
+// Amount parses a strictly positive amount
+func Amount(value string) (float64, error) {
+	n, err := number(value)
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 {
+		return 0, errors.New("Amount must be positive, got " + value)
+	}
+	return n, nil
+}
+
+// Money parses a strictly positive amount of money, refusing fractions of a cent that would be lost when the
+// amount is stored to two decimal places
+func Money(value string) (float64, error) {
+	n, err := Amount(value)
+	if err != nil {
+		return 0, err
+	}
+	if cents := n * 100; math.Abs(cents-math.Floor(cents+0.5)) > 1e-6 {
+		return 0, errors.New("Amount can't have more than two decimal places, got " + value)
+	}
+	return n, nil
+}
+
+// Balance parses an opening balance, which may be zero but not negative
+func Balance(value string) (float64, error) {
+	n, err := number(value)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, errors.New("Balance can't be negative, got " + value)
+	}
+	return n, nil
+}
+
+// Rate parses a discount rate between 0 (inclusive) and 1 (exclusive)
+func Rate(value string) (float64, error) {
+	n, err := number(value)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 || n >= 1 {
+		return 0, errors.New("Rate must be between 0 and 1, got " + value)
+	}
+	return n, nil
+}
+
+// Currency checks the code is one of Currencies
+func Currency(code string) error {
+	for _, c := range Currencies {
+		if c == code {
+			return nil
+		}
+	}
+	return errors.New("Unknown currency: " + code)
+}
+
+// schema is the subset of JSON schema the payloads use: an object of string properties
+type schema struct {
+	Properties map[string]struct {
+		Type string `json:"type"`
+	} `json:"properties"`
+	Required             []string `json:"required"`
+	AdditionalProperties bool     `json:"additionalProperties"`
+}
+
+// Payload checks a JSON object against a published schema and returns its fields. Unknown fields are refused
+// unless the schema allows additional properties, so a payload can't set fields such as status or buyer.
+func Payload(payload string, published string) (map[string]string, error) {
+	var s schema
+	if err := json.Unmarshal([]byte(published), &s); err != nil {
+		return nil, errors.New("Corrupt schema: " + err.Error())
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal([]byte(payload), &raw); err != nil {
+		return nil, errors.New("Payload is not a JSON object: " + err.Error())
+	}
+
+	fields := map[string]string{}
+	for key, val := range raw {
+		prop, known := s.Properties[key]
+		if !known {
+			if !s.AdditionalProperties {
+				return nil, errors.New("Payload field not allowed by schema: " + key)
+			}
+			continue
+		}
+		str, ok := val.(string)
+		if prop.Type == "string" && !ok {
+			return nil, errors.New("Payload field must be a string: " + key)
+		}
+		fields[key] = str
+	}
+
+	for _, key := range s.Required {
+		if _, ok := fields[key]; !ok {
+			return nil, errors.New("Payload is missing required field: " + key)
+		}
+	}
+
+	return fields, nil
+}